@@ -3,29 +3,66 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoConversion        = errors.New("no conversion")
+	ErrAmbiguousConversion = errors.New("ambiguous conversion")
 )
 
 func main() {
-	Register(toInt)
+	RegisterErr(toInt)
 	Register(toAge)
 	Register(toUserAPI)
+	RegisterContext(findUser)
 	fmt.Println(Map[int]("1234"))
 	fmt.Println(Map[Age](100))
 	fmt.Println(Map[*UserAPI](&UserDB{
 		Name: "John",
 	}))
+	// string -> int -> Age, resolved from the registered pairs.
+	fmt.Println(Map[Age]("42"))
+
+	ctx := context.Background()
+	fmt.Println(TryMap[Age](ctx, "forty-two"))
+	fmt.Println(TryMap[*UserAPI](ctx, UserID(1)))
+	fmt.Println(TryMap[*UserAPI](ctx, UserID(2)))
+	fmt.Println(TryMap[float64](ctx, "1"))
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	fmt.Println(TryMap[*UserAPI](ctx, UserID(1)))
+
+	// Scoped registries, e.g. one per test, inherit the shared converters.
+	defaultRegistry.Freeze()
+	fmt.Println(defaultRegistry.Register(Func(toAge)))
+	reg := defaultRegistry.Child()
+	fmt.Println(reg.Register(Func(func(n int) Age { return Age(n * 2) })))
+	fmt.Println(MapWith[Age](reg, "21"), Map[Age]("21"))
+
+	strict := NewRegistry(RejectDuplicate)
+	fmt.Println(strict.Register(Func(toAge)))
+	fmt.Println(strict.Register(Func(toAge)))
+
+	// The zero value is ready to use.
+	var local Registry
+	fmt.Println(local.Register(Func(toAge)))
+	fmt.Println(MapWith[Age](&local, 7))
+	fmt.Println(local.Register(Func(strings.TrimSpace)))
+	fmt.Printf("%q\n", MapWith[string](&local, "  trimmed  "))
 	fmt.Println("Hello, 世界")
 }
 
-func toInt(s string) int {
-	n, err := strconv.Atoi(s)
-	if err != nil {
-		panic(err)
-	}
-	return n
+func toInt(s string) (int, error) {
+	return strconv.Atoi(s)
 }
 
 type Age int
@@ -47,48 +84,370 @@ func toUserAPI(dto *UserDB) *UserAPI {
 	}
 }
 
-type registry struct {
-	m map[reflect.Type]map[reflect.Type]func(reflect.Value) reflect.Value
+type UserID int
+
+var ErrUserNotFound = errors.New("user not found")
+
+func findUser(ctx context.Context, id UserID) (*UserDB, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if id != 1 {
+		return nil, ErrUserNotFound
+	}
+	return &UserDB{Name: "John"}, nil
+}
+
+// converter is the common form of the registered functions.
+type converter = func(context.Context, reflect.Value) (reflect.Value, error)
+
+type edge struct {
+	from, to reflect.Type
+}
+
+var (
+	ErrFrozen    = errors.New("registry is frozen")
+	ErrDuplicate = errors.New("duplicate converter")
+)
+
+// DuplicatePolicy decides what happens when a converter is registered twice
+// for the same pair of types.
+type DuplicatePolicy int
+
+const (
+	// ReplaceDuplicate keeps the last converter registered.
+	ReplaceDuplicate DuplicatePolicy = iota
+	// KeepDuplicate keeps the first converter registered.
+	KeepDuplicate
+	// RejectDuplicate fails the registration with ErrDuplicate.
+	RejectDuplicate
+)
+
+// Registry holds the converters. It is safe for concurrent use, so packages
+// can register from their init functions while tests map in parallel. The
+// zero value is an empty registry with the ReplaceDuplicate policy.
+type Registry struct {
+	mu     sync.RWMutex
+	parent *Registry
+	policy DuplicatePolicy
+	frozen bool
+	m      map[reflect.Type]map[reflect.Type]converter
+
+	// version counts the registrations, and cache holds the chains resolved
+	// at cacheVersion, the sum of the versions up the parent chain.
+	version      uint64
+	cache        map[edge]converter
+	cacheVersion uint64
+}
+
+func NewRegistry(policy DuplicatePolicy) *Registry {
+	return &Registry{policy: policy}
+}
+
+// Child returns a registry that sees the converters of r, and can add or
+// override converters without affecting r.
+func (r *Registry) Child() *Registry {
+	c := NewRegistry(r.policy)
+	c.parent = r
+	return c
+}
+
+// Freeze rejects further registrations with ErrFrozen. Children of a frozen
+// registry can still register their own converters.
+func (r *Registry) Freeze() {
+	r.mu.Lock()
+	r.frozen = true
+	r.mu.Unlock()
+}
+
+// Converter is a function registered with Registry.Register.
+type Converter struct {
+	from, to reflect.Type
+	fn       converter
+}
+
+func Func[T, V any](fn func(T) V) Converter {
+	return FuncContext(func(_ context.Context, t T) (V, error) {
+		return fn(t), nil
+	})
+}
+
+// FuncErr wraps a converter that can fail.
+func FuncErr[T, V any](fn func(T) (V, error)) Converter {
+	return FuncContext(func(_ context.Context, t T) (V, error) {
+		return fn(t)
+	})
+}
+
+// FuncContext wraps a converter that can fail and that needs the context,
+// for example to load related data.
+func FuncContext[T, V any](fn func(context.Context, T) (V, error)) Converter {
+	var tt T
+	return Converter{
+		from: reflect.TypeFor[T](),
+		to:   reflect.TypeFor[V](),
+		fn: func(ctx context.Context, val reflect.Value) (reflect.Value, error) {
+			t, ok := reflect.TypeAssert[T](val)
+			if !ok {
+				return reflect.Value{}, fmt.Errorf("want %T, got %s", tt, val.Type())
+			}
+			res, err := fn(ctx, t)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(&res).Elem(), nil
+		},
+	}
+}
+
+// Register adds the converter, following the duplicate policy. Converters of
+// the parent registry are not duplicates, and can be overridden.
+func (r *Registry) Register(c Converter) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.frozen {
+		return fmt.Errorf("%w: %s to %s", ErrFrozen, c.from, c.to)
+	}
+	if _, ok := r.m[c.from][c.to]; ok {
+		switch r.policy {
+		case KeepDuplicate:
+			return nil
+		case RejectDuplicate:
+			return fmt.Errorf("%w: %s to %s", ErrDuplicate, c.from, c.to)
+		}
+	}
+	if r.m == nil {
+		r.m = make(map[reflect.Type]map[reflect.Type]converter)
+	}
+	if _, ok := r.m[c.from]; !ok {
+		r.m[c.from] = make(map[reflect.Type]converter)
+	}
+	r.m[c.from][c.to] = c.fn
+	r.version++
+
+	return nil
+}
+
+// edges returns the converters from the type, including the inherited ones.
+func (r *Registry) edges(from reflect.Type) map[reflect.Type]converter {
+	res := make(map[reflect.Type]converter)
+	if r.parent != nil {
+		res = r.parent.edges(from)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for to, fn := range r.m[from] {
+		res[to] = fn
+	}
+
+	return res
 }
 
-var r registry
+func (r *Registry) versions() uint64 {
+	r.mu.RLock()
+	v := r.version
+	r.mu.RUnlock()
 
-func init() {
-	r.m = make(map[reflect.Type]map[reflect.Type]func(reflect.Value) reflect.Value)
+	if r.parent != nil {
+		v += r.parent.versions()
+	}
+	return v
 }
 
+var defaultRegistry = NewRegistry(ReplaceDuplicate)
+
+// Map is like TryMap, but panics on failure.
 func Map[T any](val any) T {
-	var tt = val
-	var vv T
-	t, v := reflect.TypeOf(tt), reflect.TypeOf(vv)
-	m, ok := r.m[t]
-	if !ok {
-		panic(fmt.Errorf("input type %T not registered", tt))
+	return MapWith[T](defaultRegistry, val)
+}
+
+// MapWith is like Map, but uses the converters of the given registry.
+func MapWith[T any](r *Registry, val any) T {
+	res, err := TryMapWith[T](context.Background(), r, val)
+	if err != nil {
+		panic(err)
 	}
-	fn, ok := m[v]
-	if !ok {
-		panic(fmt.Errorf("output type %T not registered", vv))
+	return res
+}
+
+// TryMap converts the value to T through the registered converters. Errors,
+// including panics in the converters, are returned instead of raised.
+func TryMap[T any](ctx context.Context, val any) (T, error) {
+	return TryMapWith[T](ctx, defaultRegistry, val)
+}
+
+// TryMapWith is like TryMap, but uses the converters of the given registry.
+func TryMapWith[T any](ctx context.Context, r *Registry, val any) (res T, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("map %T to %T: %v", val, res, p)
+		}
+	}()
+
+	t, v := reflect.TypeOf(val), reflect.TypeFor[T]()
+	fn, err := r.lookup(t, v)
+	if err != nil {
+		return res, err
+	}
+	out, err := fn(ctx, reflect.ValueOf(val))
+	if err != nil {
+		return res, err
 	}
-	out := fn(reflect.ValueOf(val))
 	res, ok := reflect.TypeAssert[T](out)
 	if !ok {
-		panic(fmt.Errorf("want %T, got %T", vv, res))
+		return res, fmt.Errorf("want %T, got %s", res, out.Type())
 	}
-	return res
+	return res, nil
 }
 
+// Register adds the converter to the default registry, and panics if it is
+// rejected.
 func Register[T, V any](fn func(T) V) {
-	var tt T
-	var vv V
-	t, v := reflect.TypeOf(tt), reflect.TypeOf(vv)
-	if _, ok := r.m[t]; !ok {
-		r.m[t] = make(map[reflect.Type]func(reflect.Value) reflect.Value)
-	}
-	r.m[t][v] = func(val reflect.Value) reflect.Value {
-		t, ok := reflect.TypeAssert[T](val)
-		if !ok {
-			panic(fmt.Errorf("want %T, got %T", tt, val))
+	mustRegister(Func(fn))
+}
+
+// RegisterErr registers a converter that can fail.
+func RegisterErr[T, V any](fn func(T) (V, error)) {
+	mustRegister(FuncErr(fn))
+}
+
+// RegisterContext registers a converter that can fail and that needs the
+// context.
+func RegisterContext[T, V any](fn func(context.Context, T) (V, error)) {
+	mustRegister(FuncContext(fn))
+}
+
+func mustRegister(c Converter) {
+	if err := defaultRegistry.Register(c); err != nil {
+		panic(err)
+	}
+}
+
+// lookup returns the converter from one type to another, composing the
+// registered converters when there is no direct one.
+func (r *Registry) lookup(from, to reflect.Type) (converter, error) {
+	k := edge{from, to}
+	version := r.versions()
+
+	r.mu.RLock()
+	fn, ok := r.cache[k]
+	ok = ok && r.cacheVersion == version
+	r.mu.RUnlock()
+	if ok {
+		return fn, nil
+	}
+
+	chain, steps, err := r.resolve(from, to)
+	if err != nil {
+		return nil, err
+	}
+	fn = func(ctx context.Context, val reflect.Value) (reflect.Value, error) {
+		for i, c := range chain {
+			if err := ctx.Err(); err != nil {
+				return reflect.Value{}, err
+			}
+			var err error
+			val, err = c(ctx, val)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("convert %s to %s: %w", steps[i], steps[i+1], err)
+			}
+		}
+		return val, nil
+	}
+
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[edge]converter)
+	}
+	if r.cacheVersion != version {
+		clear(r.cache)
+		r.cacheVersion = version
+	}
+	r.cache[k] = fn
+	r.mu.Unlock()
+
+	return fn, nil
+}
+
+// resolve finds the shortest chain of registered converters with a
+// breadth-first search over the registered pairs, and returns it together
+// with the types along the way. It fails when there is no chain, or when
+// there is more than one shortest chain to pick from.
+func (r *Registry) resolve(from, to reflect.Type) ([]converter, []reflect.Type, error) {
+	if from == to {
+		// A registered T to T converter, such as one that normalises, wins
+		// over the identity.
+		if fn, ok := r.edges(from)[to]; ok {
+			return []converter{fn}, []reflect.Type{from, to}, nil
+		}
+		return nil, []reflect.Type{from}, nil
+	}
+
+	dist := map[reflect.Type]int{from: 0}
+	preds := make(map[reflect.Type][]reflect.Type)
+	queue := []reflect.Type{from}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if _, ok := dist[to]; ok && dist[t] >= dist[to] {
+			break
+		}
+		for v := range r.edges(t) {
+			d, ok := dist[v]
+			switch {
+			case !ok:
+				dist[v] = dist[t] + 1
+				preds[v] = []reflect.Type{t}
+				queue = append(queue, v)
+			case d == dist[t]+1:
+				preds[v] = append(preds[v], t)
+			}
+		}
+	}
+
+	paths := chains(preds, from, to, 2)
+	switch len(paths) {
+	case 0:
+		return nil, nil, fmt.Errorf("%w from %s to %s", ErrNoConversion, from, to)
+	case 1:
+	default:
+		return nil, nil, fmt.Errorf("%w from %s to %s: %s or %s", ErrAmbiguousConversion, from, to, formatChain(paths[0]), formatChain(paths[1]))
+	}
+
+	path := paths[0]
+	res := make([]converter, 0, len(path)-1)
+	for i := 1; i < len(path); i++ {
+		res = append(res, r.edges(path[i-1])[path[i]])
+	}
+
+	return res, path, nil
+}
+
+// chains walks the predecessors back from to, returning at most limit chains.
+func chains(preds map[reflect.Type][]reflect.Type, from, to reflect.Type, limit int) [][]reflect.Type {
+	if to == from {
+		return [][]reflect.Type{{from}}
+	}
+
+	var res [][]reflect.Type
+	for _, p := range preds[to] {
+		for _, c := range chains(preds, from, p, limit-len(res)) {
+			res = append(res, append(slices.Clip(c), to))
+			if len(res) == limit {
+				return res
+			}
 		}
-		return reflect.ValueOf(fn(t))
 	}
+
+	return res
+}
+
+func formatChain(path []reflect.Type) string {
+	s := make([]string, len(path))
+	for i, t := range path {
+		s[i] = t.String()
+	}
+	return strings.Join(s, " -> ")
 }
@@ -3,41 +3,197 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 )
 
-type registry map[reflect.Type]func(reflect.Value) any
+//go:generate go run mapper-gen.go -in $GOFILE -out 003-generic-api-mapper_gen.go -register store
+//mapper:map *Hobby -> *HobbyAPI
+//mapper:map *UserEntity -> *UserAPI
 
-var r = make(registry)
+// The generated mappers are registered in init, and back mapper. mapper still
+// dispatches through reflection, so hot paths should call the generated
+// mapXToY functions directly. The program needs the generated file to build:
+//
+//	go run 003-generic-api-mapper.go 003-generic-api-mapper_gen.go
 
-func load(v any) func(reflect.Value) any {
-	fn, ok := r[reflect.TypeOf(v)]
+var (
+	ErrFrozen    = errors.New("registry is frozen")
+	ErrDuplicate = errors.New("duplicate mapping")
+)
+
+// DuplicatePolicy decides what happens when a type is registered twice.
+type DuplicatePolicy int
+
+const (
+	// ReplaceDuplicate keeps the last mapping registered.
+	ReplaceDuplicate DuplicatePolicy = iota
+	// KeepDuplicate keeps the first mapping registered.
+	KeepDuplicate
+	// RejectDuplicate fails the registration with ErrDuplicate.
+	RejectDuplicate
+)
+
+// mapping converts values of a registered type to its output type. The
+// registry is passed in, so that nested values are mapped with the
+// registry the lookup started from.
+type mapping struct {
+	out reflect.Type
+	fn  func(*Registry, reflect.Value) reflect.Value
+}
+
+// Registry holds the mappings. It is safe for concurrent use. The zero value
+// is an empty registry with the ReplaceDuplicate policy.
+type Registry struct {
+	mu     sync.RWMutex
+	parent *Registry
+	policy DuplicatePolicy
+	frozen bool
+	m      map[reflect.Type]mapping
+}
+
+func NewRegistry(policy DuplicatePolicy) *Registry {
+	return &Registry{policy: policy}
+}
+
+// Child returns a registry that sees the mappings of r, and can add or
+// override mappings without affecting r.
+func (r *Registry) Child() *Registry {
+	c := NewRegistry(r.policy)
+	c.parent = r
+	return c
+}
+
+// Freeze rejects further registrations with ErrFrozen.
+func (r *Registry) Freeze() {
+	r.mu.Lock()
+	r.frozen = true
+	r.mu.Unlock()
+}
+
+func (r *Registry) add(in reflect.Type, m mapping) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.frozen {
+		return fmt.Errorf("%w: %s", ErrFrozen, in)
+	}
+	if _, ok := r.m[in]; ok {
+		switch r.policy {
+		case KeepDuplicate:
+			return nil
+		case RejectDuplicate:
+			return fmt.Errorf("%w: %s", ErrDuplicate, in)
+		}
+	}
+	if r.m == nil {
+		r.m = make(map[reflect.Type]mapping)
+	}
+	r.m[in] = m
+
+	return nil
+}
+
+// get looks the type up in r and then in its parents.
+func (r *Registry) get(t reflect.Type) (mapping, bool) {
+	r.mu.RLock()
+	m, ok := r.m[t]
+	r.mu.RUnlock()
+
+	if !ok && r.parent != nil {
+		return r.parent.get(t)
+	}
+	return m, ok
+}
+
+func (r *Registry) load(t reflect.Type) mapping {
+	m, ok := r.get(t)
 	if !ok {
-		panic(fmt.Errorf("type %T is not registered", v))
+		panic(fmt.Errorf("type %s is not registered", t))
 	}
-	return fn
+	return m
 }
 
+var defaultRegistry = NewRegistry(ReplaceDuplicate)
+
+// store registers fn in the default registry, and panics if it is rejected.
 func store[T, V any](fn func(T) V) {
+	if err := storeIn(defaultRegistry, fn); err != nil {
+		panic(err)
+	}
+}
+
+func storeIn[T, V any](r *Registry, fn func(T) V) error {
 	var tt T
-	var t = reflect.TypeOf(tt)
-	r[t] = func(v reflect.Value) any {
-		in, ok := reflect.TypeAssert[T](v)
-		if !ok {
-			panic(fmt.Errorf("want %T, got %v", tt, v))
-		}
-		return fn(in)
+	return r.add(reflect.TypeFor[T](), mapping{
+		out: reflect.TypeFor[V](),
+		fn: func(_ *Registry, v reflect.Value) reflect.Value {
+			in, ok := reflect.TypeAssert[T](v)
+			if !ok {
+				panic(fmt.Errorf("want %T, got %v", tt, v))
+			}
+			out := fn(in)
+			return reflect.ValueOf(&out).Elem()
+		},
+	})
+}
+
+// storeAuto registers a converter from T to V that copies the fields with
+// the same name, mapping the values of other registered types on the way. T
+// and V are structs or pointers to structs.
+func storeAuto[T, V any]() {
+	if err := storeAutoIn[T, V](defaultRegistry); err != nil {
+		panic(err)
 	}
 }
 
+func storeAutoIn[T, V any](r *Registry) error {
+	out := reflect.TypeFor[V]()
+	return r.add(reflect.TypeFor[T](), mapping{
+		out: out,
+		fn: func(r *Registry, v reflect.Value) reflect.Value {
+			return r.autoMap(v, out)
+		},
+	})
+}
+
 func main() {
-	store(toUserAPI)
-	ent := &UserEntity{Name: "John"}
+	ent := &UserEntity{
+		Name:  "John",
+		Age:   20,
+		Hobby: []*Hobby{{Name: "chess"}, {Name: "go"}},
+	}
 	debugOutput(mapper(ent))
 	debugOutput(mapper(*ent))
 	debugOutput(mapper([]UserEntity{*ent}))
 	debugOutput(mapper([]*UserEntity{ent}))
+	debugOutput(mapper(map[string]*UserEntity{"john": ent}))
+
+	// Hot paths skip the registry.
+	debugOutput(mapUserEntityToUserAPI(ent))
+
+	// Replace the generated mapper with one that copies the fields by
+	// reflection.
+	storeAuto[*UserEntity, *UserAPI]()
+	debugOutput(mapper([]*UserEntity{ent}))
+
+	// A child registry overrides a mapping without touching the default one.
+	defaultRegistry.Freeze()
+	fmt.Println(storeIn(defaultRegistry, toHobbyAPI))
+	reg := defaultRegistry.Child()
+	fmt.Println(storeIn(reg, func(h *Hobby) *HobbyAPI {
+		return &HobbyAPI{Name: strings.ToUpper(h.Name)}
+	}))
+	debugOutput(reg.mapper(ent).(*UserAPI).Hobby[0])
+	debugOutput(mapper(ent).(*UserAPI).Hobby[0])
+
+	// The zero value is ready to use.
+	var local Registry
+	fmt.Println(storeIn(&local, toHobbyAPI))
+	debugOutput(local.mapper(&Hobby{Name: "go"}))
 }
 
 func debugOutput(v any) {
@@ -46,43 +202,156 @@ func debugOutput(v any) {
 	fmt.Println()
 }
 
+// mapper converts the value through the default registry. Slices, arrays,
+// maps and pointers of registered types are mapped element by element, so
+// that []*UserEntity becomes []*UserAPI.
 func mapper(val any) any {
-	v := reflect.ValueOf(val)
+	return defaultRegistry.mapper(val)
+}
+
+// mapper is like the package-level mapper, but uses the mappings of r.
+func (r *Registry) mapper(val any) any {
+	if val == nil {
+		return nil
+	}
+	return r.mapValue(reflect.ValueOf(val)).Interface()
+}
+
+func (r *Registry) mapValue(v reflect.Value) reflect.Value {
+	if m, ok := r.get(v.Type()); ok {
+		return m.fn(r, v)
+	}
+
+	out, ok := r.outType(v.Type())
+	if !ok {
+		panic(fmt.Errorf("type %s is not registered", v.Type()))
+	}
 
-	fmt.Println(v.Kind())
-	// Check if the Kind of the value is a slice
 	switch v.Kind() {
 	case reflect.Slice:
-		var result []any
+		if v.IsNil() {
+			return reflect.Zero(out)
+		}
+		res := reflect.MakeSlice(out, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(r.mapValue(v.Index(i)))
+		}
+		return res
+	case reflect.Array:
+		res := reflect.New(out).Elem()
 		for i := 0; i < v.Len(); i++ {
-			result = append(result, mapper(v.Index(i).Interface()))
+			res.Index(i).Set(r.mapValue(v.Index(i)))
 		}
-		return result
+		return res
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(out)
+		}
+		res := reflect.MakeMapWithSize(out, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			res.SetMapIndex(iter.Key(), r.mapValue(iter.Value()))
+		}
+		return res
+	case reflect.Pointer:
+		if v.IsNil() {
+			return reflect.Zero(out)
+		}
+		res := reflect.New(out.Elem())
+		res.Elem().Set(r.mapValue(v.Elem()))
+		return res
 	case reflect.Struct:
+		// Only the pointer type is registered.
 		nv := reflect.New(v.Type())
 		nv.Elem().Set(v)
-		return mapper(nv.Interface())
+		return r.load(nv.Type()).fn(r, nv)
+	}
+
+	panic(fmt.Errorf("type %s is not registered", v.Type()))
+}
+
+// outType returns the type that values of t are mapped to.
+func (r *Registry) outType(t reflect.Type) (reflect.Type, bool) {
+	if m, ok := r.get(t); ok {
+		return m.out, true
+	}
+
+	switch t.Kind() {
+	case reflect.Slice:
+		if e, ok := r.outType(t.Elem()); ok {
+			return reflect.SliceOf(e), true
+		}
+	case reflect.Array:
+		if e, ok := r.outType(t.Elem()); ok {
+			return reflect.ArrayOf(t.Len(), e), true
+		}
+	case reflect.Map:
+		if e, ok := r.outType(t.Elem()); ok {
+			return reflect.MapOf(t.Key(), e), true
+		}
 	case reflect.Pointer:
-		el := v.Elem()
-		if el.Kind() != reflect.Struct {
-			panic("not a struct")
+		if m, ok := r.get(t.Elem()); ok {
+			return reflect.PointerTo(m.out), true
+		}
+	case reflect.Struct:
+		if m, ok := r.get(reflect.PointerTo(t)); ok {
+			return m.out, true
 		}
-		return load(val)(v)
 	}
-	return nil
+
+	return nil, false
 }
 
-func toUserAPIValue(val reflect.Value) any {
-	v, ok := reflect.TypeAssert[*UserEntity](val)
-	if !ok {
-		panic(fmt.Errorf("want %T, got %T", &UserEntity{}, val))
+// autoMap copies the fields of v into a new value of type out by name.
+// Fields missing from either side are skipped.
+func (r *Registry) autoMap(v reflect.Value, out reflect.Type) reflect.Value {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Zero(out)
+		}
+		v = v.Elem()
+	}
+
+	t := out
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	res := reflect.New(t)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		sv := v.FieldByName(f.Name)
+		if !sv.IsValid() {
+			continue
+		}
+		res.Elem().Field(i).Set(r.convertField(sv, f))
+	}
+
+	if out.Kind() == reflect.Pointer {
+		return res
+	}
+	return res.Elem()
+}
+
+func (r *Registry) convertField(v reflect.Value, f reflect.StructField) reflect.Value {
+	if v.Type().AssignableTo(f.Type) {
+		return v
+	}
+	if t, ok := r.outType(v.Type()); ok && t.AssignableTo(f.Type) {
+		return r.mapValue(v)
+	}
+	// Named types with the same underlying kind, such as Age and int.
+	if v.Kind() == f.Type.Kind() && v.Type().ConvertibleTo(f.Type) {
+		return v.Convert(f.Type)
 	}
-	return toUserAPI(v)
+	panic(fmt.Errorf("cannot map field %s from %s to %s", f.Name, v.Type(), f.Type))
 }
 
-func toUserAPI(e *UserEntity) *UserAPI {
-	return &UserAPI{
-		Name: e.Name,
+func toHobbyAPI(h *Hobby) *HobbyAPI {
+	return &HobbyAPI{
+		Name: h.Name,
 	}
 }
 
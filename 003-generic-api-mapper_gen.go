@@ -0,0 +1,33 @@
+// Code generated by mapper-gen.go from 003-generic-api-mapper.go; DO NOT EDIT.
+
+package main
+
+func mapHobbyToHobbyAPI(in *Hobby) *HobbyAPI {
+	if in == nil {
+		return nil
+	}
+	out := new(HobbyAPI)
+	out.Name = in.Name
+	return out
+}
+
+func mapUserEntityToUserAPI(in *UserEntity) *UserAPI {
+	if in == nil {
+		return nil
+	}
+	out := new(UserAPI)
+	out.Name = in.Name
+	out.Age = in.Age
+	if in.Hobby != nil {
+		out.Hobby = make([]*HobbyAPI, len(in.Hobby))
+		for i0, v0 := range in.Hobby {
+			out.Hobby[i0] = mapHobbyToHobbyAPI(v0)
+		}
+	}
+	return out
+}
+
+func init() {
+	store(mapHobbyToHobbyAPI)
+	store(mapUserEntityToUserAPI)
+}
@@ -1,39 +1,544 @@
+// This program packs items into fixed-capacity bins with different
+// heuristics, and compares how well each one fills the bins.
+//
+//	go run bin-packing.go -capacity 20 items.json
+//
+// where items.json holds [{"id": "a", "weight": 3}, ...].
+//
+// With -node, it instead schedules tasks onto nodes with several resource
+// dimensions, honouring affinity, anti-affinity and conflicts:
+//
+//	go run bin-packing.go -node cpu=4,memory=8192 -max-nodes 3 tasks.json
+//
+// where tasks.json holds [{"id": "web-1", "size": {"cpu": 1}, "anti_affinity": "web"}, ...].
 package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 )
 
-const max = 20
+var (
+	ErrItemTooLarge  = errors.New("item does not fit in an empty bin")
+	ErrInvalidWeight = errors.New("invalid weight")
+	ErrMaxBins       = errors.New("no bin has room and the bin limit is reached")
+	ErrAntiAffinity  = errors.New("anti-affinity group cannot share a bin")
+	ErrConflict      = errors.New("conflicting items cannot share a bin")
+)
+
+type Item struct {
+	ID     string `json:"id"`
+	Weight int    `json:"weight"`
+}
 
 type Bin struct {
-	Items []int
-	Space int
+	Items    []Item `json:"items"`
+	Capacity int    `json:"capacity"`
+	Space    int    `json:"space"`
 }
 
-func main() {
-	items := []int{20, 1, 3, 5, 12, 17, 7}
-	bins := make([]*Bin, 0)
+func (b *Bin) add(item Item) {
+	b.Items = append(b.Items, item)
+	b.Space -= item.Weight
+}
+
+// Strategy places every item into bins of the given capacity.
+type Strategy interface {
+	Pack(items []Item, capacity int) ([]*Bin, error)
+}
+
+// fit returns the index of the open bin to place the item in, or -1 to open
+// a new bin.
+type fit func(bins []*Bin, item Item) int
+
+type heuristic struct {
+	fit fit
+
+	// decreasing sorts the items by weight, heaviest first.
+	decreasing bool
+}
+
+func (h heuristic) Pack(items []Item, capacity int) ([]*Bin, error) {
+	for _, item := range items {
+		if item.Weight < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidWeight, item.ID)
+		}
+		if item.Weight > capacity {
+			return nil, fmt.Errorf("%w: %s", ErrItemTooLarge, item.ID)
+		}
+	}
+
+	if h.decreasing {
+		items = append([]Item(nil), items...)
+		sort.SliceStable(items, func(i, j int) bool {
+			return items[i].Weight > items[j].Weight
+		})
+	}
 
+	var bins []*Bin
 	for _, item := range items {
-		var done bool
-		for _, bin := range bins {
-			if bin.Space >= item {
-				bin.Items = append(bin.Items, item)
-				bin.Space -= item
-				done = true
-				break
+		i := h.fit(bins, item)
+		if i == -1 {
+			bins = append(bins, &Bin{Capacity: capacity, Space: capacity})
+			i = len(bins) - 1
+		}
+		bins[i].add(item)
+	}
+
+	return bins, nil
+}
+
+var (
+	// NextFit only considers the last bin opened.
+	NextFit Strategy = heuristic{fit: nextFit}
+	// FirstFit picks the first bin with enough space.
+	FirstFit Strategy = heuristic{fit: firstFit}
+	// FirstFitDecreasing is FirstFit over the items sorted by weight.
+	FirstFitDecreasing Strategy = heuristic{fit: firstFit, decreasing: true}
+	// BestFit picks the bin that is left with the least space.
+	BestFit Strategy = heuristic{fit: bestFit}
+	// WorstFit picks the bin that is left with the most space.
+	WorstFit Strategy = heuristic{fit: worstFit}
+)
+
+var strategies = []struct {
+	name     string
+	strategy Strategy
+}{
+	{"next-fit", NextFit},
+	{"first-fit", FirstFit},
+	{"first-fit-decreasing", FirstFitDecreasing},
+	{"best-fit", BestFit},
+	{"worst-fit", WorstFit},
+}
+
+func nextFit(bins []*Bin, item Item) int {
+	if n := len(bins); n > 0 && bins[n-1].Space >= item.Weight {
+		return n - 1
+	}
+	return -1
+}
+
+func firstFit(bins []*Bin, item Item) int {
+	for i, bin := range bins {
+		if bin.Space >= item.Weight {
+			return i
+		}
+	}
+	return -1
+}
+
+func bestFit(bins []*Bin, item Item) int {
+	best := -1
+	for i, bin := range bins {
+		if bin.Space >= item.Weight && (best == -1 || bin.Space < bins[best].Space) {
+			best = i
+		}
+	}
+	return best
+}
+
+func worstFit(bins []*Bin, item Item) int {
+	worst := -1
+	for i, bin := range bins {
+		if bin.Space >= item.Weight && (worst == -1 || bin.Space > bins[worst].Space) {
+			worst = i
+		}
+	}
+	return worst
+}
+
+// Stats summarises how well the bins are filled.
+type Stats struct {
+	Bins        int     `json:"bins"`
+	Items       int     `json:"items"`
+	Capacity    int     `json:"capacity"`
+	Used        int     `json:"used"`
+	Wasted      int     `json:"wasted"`
+	Utilisation float64 `json:"utilisation"`
+	MinFill     float64 `json:"min_fill"`
+	MaxFill     float64 `json:"max_fill"`
+}
+
+func stats(bins []*Bin) Stats {
+	var s Stats
+	for i, bin := range bins {
+		used := bin.Capacity - bin.Space
+		s.Bins++
+		s.Items += len(bin.Items)
+		s.Capacity += bin.Capacity
+		s.Used += used
+
+		fill := 1.0
+		if bin.Capacity > 0 {
+			fill = float64(used) / float64(bin.Capacity)
+		}
+		if i == 0 || fill < s.MinFill {
+			s.MinFill = fill
+		}
+		if fill > s.MaxFill {
+			s.MaxFill = fill
+		}
+	}
+
+	s.Wasted = s.Capacity - s.Used
+	if s.Capacity > 0 {
+		s.Utilisation = float64(s.Used) / float64(s.Capacity)
+	}
+	return s
+}
+
+// Resources is a vector of sizes by dimension, such as cpu, memory and disk.
+// Missing dimensions are zero.
+type Resources map[string]int
+
+// fits reports whether r fits in the free resources.
+func (r Resources) fits(free Resources) bool {
+	for d, n := range r {
+		if n > free[d] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Resources) add(o Resources, sign int) {
+	for d, n := range o {
+		r[d] += sign * n
+	}
+}
+
+// share is the largest fraction of the capacity that r takes in any
+// dimension, used to order tasks from the hardest to place.
+func (r Resources) share(capacity Resources) float64 {
+	var max float64
+	for d, n := range r {
+		if n == 0 {
+			continue
+		}
+		c := capacity[d]
+		if c <= 0 {
+			return math.Inf(1)
+		}
+		if f := float64(n) / float64(c); f > max {
+			max = f
+		}
+	}
+	return max
+}
+
+// Task is an item with a size in several dimensions.
+type Task struct {
+	ID   string    `json:"id"`
+	Size Resources `json:"size"`
+
+	// Tasks with the same affinity group are placed on the same node.
+	Affinity string `json:"affinity,omitempty"`
+	// Tasks with the same anti-affinity group are placed on different nodes.
+	AntiAffinity string `json:"anti_affinity,omitempty"`
+	// Conflicts lists the tasks that must not share a node with this one, in
+	// either direction.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+type Node struct {
+	Tasks    []Task    `json:"tasks"`
+	Capacity Resources `json:"capacity"`
+	Free     Resources `json:"free"`
+}
+
+// Unplaced is a task that could not be placed, with the reason.
+type Unplaced struct {
+	Task   Task  `json:"task"`
+	Reason error `json:"-"`
+}
+
+func (u Unplaced) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Task   Task   `json:"task"`
+		Reason string `json:"reason"`
+	}{u.Task, u.Reason.Error()})
+}
+
+type Placement struct {
+	Nodes    []*Node    `json:"nodes"`
+	Unplaced []Unplaced `json:"unplaced"`
+}
+
+// Scheduler places tasks onto identical nodes.
+type Scheduler struct {
+	Capacity Resources
+	// MaxNodes caps the number of nodes opened, 0 for no limit.
+	MaxNodes int
+}
+
+// Schedule places the tasks with first fit decreasing, ordering them by
+// their dominant share of the capacity. Tasks of an affinity group are
+// placed together as one unit. Tasks that cannot be placed are returned in
+// the placement with the reason, rather than failing the whole schedule.
+func (s Scheduler) Schedule(tasks []Task) Placement {
+	var (
+		p     Placement
+		units [][]Task
+		index = make(map[string]int)
+	)
+	for _, t := range tasks {
+		if t.Affinity == "" {
+			units = append(units, []Task{t})
+			continue
+		}
+		i, ok := index[t.Affinity]
+		if !ok {
+			i = len(units)
+			index[t.Affinity] = i
+			units = append(units, nil)
+		}
+		units[i] = append(units[i], t)
+	}
+
+	sizes := make([]Resources, len(units))
+	for i, u := range units {
+		sizes[i] = make(Resources)
+		for _, t := range u {
+			sizes[i].add(t.Size, 1)
+		}
+	}
+	order := make([]int, len(units))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return sizes[order[i]].share(s.Capacity) > sizes[order[j]].share(s.Capacity)
+	})
+
+	conflicts := make(map[[2]string]bool)
+	for _, t := range tasks {
+		for _, id := range t.Conflicts {
+			conflicts[[2]string{t.ID, id}] = true
+			conflicts[[2]string{id, t.ID}] = true
+		}
+	}
+
+	for _, i := range order {
+		u, size := units[i], sizes[i]
+		if err := s.place(&p, u, size, conflicts); err != nil {
+			for _, t := range u {
+				p.Unplaced = append(p.Unplaced, Unplaced{t, err})
+			}
+		}
+	}
+
+	return p
+}
+
+func (s Scheduler) place(p *Placement, unit []Task, size Resources, conflicts map[[2]string]bool) error {
+	for _, t := range unit {
+		for d, n := range t.Size {
+			if n < 0 {
+				return fmt.Errorf("%w: %s %s", ErrInvalidWeight, t.ID, d)
+			}
+		}
+	}
+	if !size.fits(s.Capacity) {
+		return ErrItemTooLarge
+	}
+	// The tasks of the unit must be able to share a node with each other.
+	for i, x := range unit {
+		for _, y := range unit[i+1:] {
+			if err := clash(x, y, conflicts); err != nil {
+				return err
+			}
+		}
+	}
+
+	var blocked error
+	for _, n := range p.Nodes {
+		if !size.fits(n.Free) {
+			continue
+		}
+		if err := compatible(unit, n.Tasks, conflicts); err != nil {
+			blocked = err
+			continue
+		}
+		n.place(unit)
+		return nil
+	}
+
+	if s.MaxNodes > 0 && len(p.Nodes) >= s.MaxNodes {
+		if blocked != nil {
+			return blocked
+		}
+		return ErrMaxBins
+	}
+	n := &Node{Capacity: s.Capacity, Free: make(Resources)}
+	n.Free.add(s.Capacity, 1)
+	n.place(unit)
+	p.Nodes = append(p.Nodes, n)
+
+	return nil
+}
+
+func (n *Node) place(unit []Task) {
+	for _, t := range unit {
+		n.Tasks = append(n.Tasks, t)
+		n.Free.add(t.Size, -1)
+	}
+}
+
+// compatible checks that the tasks of a can share a node with those of b.
+func compatible(a, b []Task, conflicts map[[2]string]bool) error {
+	for _, x := range a {
+		for _, y := range b {
+			if err := clash(x, y, conflicts); err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
+
+func clash(x, y Task, conflicts map[[2]string]bool) error {
+	if x.AntiAffinity != "" && x.AntiAffinity == y.AntiAffinity {
+		return fmt.Errorf("%w: %s", ErrAntiAffinity, x.AntiAffinity)
+	}
+	if conflicts[[2]string{x.ID, y.ID}] {
+		return fmt.Errorf("%w: %s and %s", ErrConflict, x.ID, y.ID)
+	}
+	return nil
+}
+
+// Utilisation returns the fraction of the capacity used in each dimension,
+// over all the nodes.
+func (p Placement) Utilisation() map[string]float64 {
+	used, capacity := make(Resources), make(Resources)
+	for _, n := range p.Nodes {
+		capacity.add(n.Capacity, 1)
+		used.add(n.Capacity, 1)
+		used.add(n.Free, -1)
+	}
+	res := make(map[string]float64)
+	for d, c := range capacity {
+		if c > 0 {
+			res[d] = float64(used[d]) / float64(c)
+		}
+	}
+	return res
+}
+
+// parseResources parses cpu=4,memory=8192.
+func parseResources(s string) (Resources, error) {
+	r := make(Resources)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("want dimension=size, got %q", kv)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		r[strings.TrimSpace(k)] = n
+	}
+	return r, nil
+}
+
+func schedule(node string, maxNodes int, file string) {
+	capacity, err := parseResources(node)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		if !done {
-			bins = append(bins, &Bin{
-				Items: []int{item},
-				Space: max - item,
-			})
+	tasks := []Task{
+		{ID: "db", Size: Resources{"cpu": 2, "memory": 4096}, Conflicts: []string{"batch"}},
+		{ID: "web-1", Size: Resources{"cpu": 1, "memory": 1024}, AntiAffinity: "web"},
+		{ID: "web-2", Size: Resources{"cpu": 1, "memory": 1024}, AntiAffinity: "web"},
+		{ID: "web-3", Size: Resources{"cpu": 1, "memory": 1024}, AntiAffinity: "web"},
+		{ID: "cache", Size: Resources{"cpu": 1, "memory": 2048}, Affinity: "api"},
+		{ID: "api", Size: Resources{"cpu": 1, "memory": 1024}, Affinity: "api"},
+		{ID: "batch", Size: Resources{"cpu": 2, "memory": 2048}},
+		{ID: "huge", Size: Resources{"cpu": 8}},
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tasks = nil
+		if err := json.Unmarshal(b, &tasks); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	json.NewEncoder(os.Stdout).Encode(bins)
+	p := Scheduler{Capacity: capacity, MaxNodes: maxNodes}.Schedule(tasks)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "node\ttasks\tfree")
+	for i, n := range p.Nodes {
+		ids := make([]string, len(n.Tasks))
+		for j, t := range n.Tasks {
+			ids[j] = t.ID
+		}
+		fmt.Fprintf(w, "%d\t%s\t%v\n", i, strings.Join(ids, ","), n.Free)
+	}
+	w.Flush()
+	for _, u := range p.Unplaced {
+		fmt.Printf("unplaced %s: %v\n", u.Task.ID, u.Reason)
+	}
+	fmt.Printf("utilisation %v\n", p.Utilisation())
+}
+
+func main() {
+	capacity := flag.Int("capacity", 20, "the capacity of each bin")
+	verbose := flag.Bool("v", false, "print the bins of each strategy")
+	node := flag.String("node", "", "schedule tasks onto nodes of this capacity, e.g. cpu=4,memory=8192")
+	maxNodes := flag.Int("max-nodes", 0, "the maximum number of nodes, 0 for no limit")
+	flag.Parse()
+
+	if *node != "" {
+		schedule(*node, *maxNodes, flag.Arg(0))
+		return
+	}
+
+	items := []Item{
+		{"a", 20}, {"b", 1}, {"c", 3}, {"d", 5}, {"e", 12}, {"f", 17}, {"g", 7},
+	}
+	if file := flag.Arg(0); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		items = nil
+		if err := json.Unmarshal(b, &items); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	packed := make(map[string][]*Bin)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "strategy\tbins\tutilisation\twasted\tmin fill\tmax fill")
+	for _, s := range strategies {
+		bins, err := s.strategy.Pack(items, *capacity)
+		if err != nil {
+			log.Fatalf("%s: %v", s.name, err)
+		}
+		packed[s.name] = bins
+		st := stats(bins)
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%d\t%.1f%%\t%.1f%%\n", s.name, st.Bins, st.Utilisation*100, st.Wasted, st.MinFill*100, st.MaxFill*100)
+	}
+	w.Flush()
+
+	if *verbose {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(packed)
+	}
 }
@@ -1,31 +1,350 @@
+// This program chains Go stages and external commands through io.Pipe,
+// like a shell pipeline:
+//
+//	Pipe(Command("cat", "out.json"), Func(upper), Command("gzip")).Run(ctx, nil, w)
+//
+// Pipes are synchronous, so a slow stage holds back the stages before it
+// instead of buffering. When a stage fails, its pipes are closed with the
+// error and the context of the other stages is cancelled, which kills the
+// commands, so that no goroutine or process is left behind.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func main() {
-	pr, pw := io.Pipe()
-	defer pw.Close()
+// Stage reads its input to the end, and writes its output.
+type Stage interface {
+	Run(ctx context.Context, r io.Reader, w io.Writer) error
+}
+
+// Func is a stage written in Go. It must return when the context is done.
+type Func func(ctx context.Context, r io.Reader, w io.Writer) error
+
+func (f Func) Run(ctx context.Context, r io.Reader, w io.Writer) error {
+	return f(ctx, r, w)
+}
+
+func (f Func) String() string {
+	return "func"
+}
+
+type command struct {
+	name string
+	args []string
+}
 
-	// cmd := exec.Command("cat", "out.json")
-	// cmd.Stdout = pw
+// Command is a stage that runs an external command, with the input on its
+// stdin and the output on its stdout. Its stderr is kept for the error.
+func Command(name string, args ...string) Stage {
+	return &command{name, args}
+}
+
+func (c *command) String() string {
+	return strings.Join(append([]string{c.name}, c.args...), " ")
+}
+
+func (c *command) Run(ctx context.Context, r io.Reader, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.name, c.args...)
+	cmd.Stdout = w
+	cmd.Stderr = &limitedBuffer{buf: &stderr, n: 4 << 10}
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	// Stop waiting for the copies of stdin and stdout once the process has
+	// exited, and kill it if it ignores SIGTERM.
+	cmd.WaitDelay = time.Second
+
+	// The input is copied by hand rather than by exec, which would wait for
+	// the copy to end, so that a command exiting without reading all of it,
+	// like true, succeeds. Wait closes stdin, and the copy stops at its next
+	// write; a read still blocked on a pipe ends when the pipeline closes it.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 	go func() {
-		defer pr.Close()
-		if _, err := io.Copy(os.Stdout, pr); err != nil {
-			log.Fatal(err)
-		}
+		io.Copy(stdin, r)
+		stdin.Close()
 	}()
-	n, err := pw.Write([]byte("hello world, this is amazing"))
-	if err != nil {
-		log.Println(err)
+
+	err = cmd.Wait()
+	if err != nil && stderr.Len() > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// limitedBuffer keeps the first n bytes written, and discards the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if rest := b.n - b.buf.Len(); rest > 0 {
+		b.buf.Write(p[:min(len(p), rest)])
+	}
+	return len(p), nil
+}
+
+// StageError is the error of one stage of a pipeline.
+type StageError struct {
+	Index int
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %d (%s): %v", e.Index, e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit status of the pipeline, like a shell with
+// pipefail: 0 on success, the status of the last command that failed, or 1
+// for the other failures.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var errs []error
+	if j, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = j.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+	for i := len(errs) - 1; i >= 0; i-- {
+		var ee *exec.ExitError
+		if errors.As(errs[i], &ee) && ee.ExitCode() > 0 {
+			return ee.ExitCode()
+		}
+	}
+	return 1
+}
+
+var ErrEmptyPipeline = errors.New("pipeline has no stages")
+
+type Pipeline struct {
+	stages []Stage
+}
+
+func Pipe(stages ...Stage) *Pipeline {
+	return &Pipeline{stages}
+}
+
+// Run runs the stages concurrently, from in to out, and waits for all of
+// them. A nil in is empty. A pipeline without stages fails with
+// ErrEmptyPipeline.
+//
+// The error joins the StageErrors in stage order. Stages that only failed
+// because another one did, with a closed pipe or a cancelled context, are
+// left out. A stage whose output is closed early, like the input of head,
+// succeeds.
+func (p *Pipeline) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	if len(p.stages) == 0 {
+		return ErrEmptyPipeline
+	}
+	if in == nil {
+		in = strings.NewReader("")
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	n := len(p.stages)
+	readers := make([]io.Reader, n)
+	writers := make([]io.Writer, n)
+	readers[0], writers[n-1] = in, out
+	for i := 1; i < n; i++ {
+		pr, pw := io.Pipe()
+		readers[i], writers[i-1] = pr, pw
+	}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, n)
+	)
+	for i, s := range p.stages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := s.Run(ctx, readers[i], writers[i])
+			if brokenPipe(err) {
+				// The next stage stopped reading, either done early like
+				// head, or failed with its own error.
+				err = nil
+			}
+			if err != nil {
+				errs[i] = err
+				cancel(&StageError{i, fmt.Sprint(s), err})
+			}
+
+			// Closing the output ends the input of the next stage, with the
+			// error if any. Closing the input makes the previous stage fail
+			// on write if it is still running, like SIGPIPE.
+			var perr error
+			if err != nil {
+				perr = &pipeError{err}
+			}
+			if pw, ok := writers[i].(*io.PipeWriter); ok {
+				pw.CloseWithError(perr)
+			}
+			if pr, ok := readers[i].(*io.PipeReader); ok {
+				pr.CloseWithError(perr)
+			}
+		}()
+	}
+	wg.Wait()
+
+	cause := context.Cause(ctx)
+	var res []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if cause != nil && secondary(err) {
+			var se *StageError
+			if !errors.As(cause, &se) || se.Index != i {
+				continue
+			}
+		}
+		res = append(res, &StageError{i, fmt.Sprint(p.stages[i]), err})
+	}
+	if len(res) == 0 && ctx.Err() != nil && !errors.As(cause, new(*StageError)) {
+		return cause
+	}
+	return errors.Join(res...)
+}
+
+// pipeError is the error of a stage, as seen by its neighbours through the
+// pipes.
+type pipeError struct {
+	err error
+}
+
+func (e *pipeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pipeError) Unwrap() error {
+	return e.err
+}
+
+func brokenPipe(err error) bool {
+	if errors.Is(err, io.ErrClosedPipe) || errors.Is(err, syscall.EPIPE) {
+		return true
 	}
-	log.Println("n", n)
+	return signaled(err, syscall.SIGPIPE)
+}
+
+// secondary reports whether the error is a consequence of another stage
+// failing, or of the pipeline being cancelled: the error of a neighbour, a
+// context error, or a command killed for it.
+func secondary(err error) bool {
+	var pe *pipeError
+	if errors.As(err, &pe) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return signaled(err, syscall.SIGTERM, syscall.SIGKILL)
+}
+
+func signaled(err error, sigs ...syscall.Signal) bool {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return false
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return false
+	}
+	for _, sig := range sigs {
+		if ws.Signal() == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// upper is a Go stage that upper-cases the lines.
+func upper(ctx context.Context, r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, strings.ToUpper(sc.Text())); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func main() {
+	ctx := context.Background()
+
+	// cat out.json | jq -c '.[]' | upper | gzip | gzip -d
+	err := Pipe(
+		Command("cat", "out.json"),
+		Command("jq", "-c", ".[]"),
+		Func(upper),
+		Command("gzip"),
+		Command("gzip", "-d"),
+	).Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d: %v", ExitCode(err), err)
+
+	// A failing command ends the pipeline, and its status is reported.
+	err = Pipe(
+		Command("cat", "out.json"),
+		Command("jq", ".[0] | .x +"),
+		Func(upper),
+	).Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d: %v", ExitCode(err), err)
+
+	// A failing Go stage kills the commands still running.
+	start := time.Now()
+	err = Pipe(
+		Command("sleep", "10"),
+		Func(func(ctx context.Context, r io.Reader, w io.Writer) error {
+			return errors.New("bad record")
+		}),
+		Command("cat"),
+	).Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d after %s: %v", ExitCode(err), time.Since(start).Round(100*time.Millisecond), err)
+
+	// Stopping early is not an error for the stages before.
+	err = Pipe(Command("cat", "out.json"), Func(upper), Command("head", "-n", "2")).Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d: %v", ExitCode(err), err)
+
+	// A command may exit without reading its input, like in a shell.
+	err = Pipe(Command("sleep", "2"), Command("true")).Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d: %v", ExitCode(err), err)
 
-	// if err := cmd.Run(); err != nil {
-	// 	log.Fatal(err)
-	// }
+	err = Pipe().Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d: %v", ExitCode(err), err)
 
+	// Cancelling the context kills the commands too.
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	err = Pipe(Command("sleep", "10"), Command("cat")).Run(ctx, nil, os.Stdout)
+	log.Printf("exit %d: %v", ExitCode(err), err)
 }
@@ -1,13 +1,91 @@
 package main
 
 import (
+	"container/list"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrTypeMismatch    = errors.New("type mismatch")
+	ErrIndexOutOfRange = errors.New("index out of range")
+)
+
+// PathError records the path segment at which an operation failed. Err is
+// one of the sentinel errors above, or another error for unsupported
+// operations.
+type PathError struct {
+	Path     string // The path up to and including the failing segment.
+	Segment  any    // The failing key or index.
+	Index    int    // The position of the segment in the path.
+	Expected string // The kind that was expected, for ErrTypeMismatch.
+	Actual   string // The kind that was found, for ErrTypeMismatch.
+	Err      error
+}
+
+func (e *PathError) Error() string {
+	if e.Expected != "" {
+		return fmt.Sprintf("%s: %s: want %s, got %s", e.Err, e.Path, e.Expected, e.Actual)
+	}
+
+	return fmt.Sprintf("%s: %s", e.Err, e.Path)
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// Match is a single query result together with its resolved path. The path
+// can be passed back to get or set.
+type Match struct {
+	Path  string
+	Value any
+}
+
+// wildcard selects every element of a slice or every value of a map, e.g.
+// a[*], a[] or a.*.
+type wildcard struct{}
+
+// slice selects a range of elements, e.g. a[1:3], a[-2:] or a[::-1].
+type slice struct {
+	start, end *int
+	step       int
+}
+
+// filter selects the children for which the expression holds, e.g.
+// a[?(@.age > 3 && @.name == 'john')]. The conditions are stored as a
+// disjunction of conjunctions.
+type filter struct {
+	expr string
+	or   [][]cond
+}
+
+type cond struct {
+	path  []any
+	op    string
+	value any
+}
+
+// descent applies the selector to the node and all of its descendants, e.g.
+// ..name or ..[0].
+type descent struct {
+	key any
+}
+
+type match struct {
+	path  []any
+	value any
+}
 
 func main() {
 	data := map[string]any{
@@ -24,6 +102,12 @@ func main() {
 				},
 			},
 		},
+		"users": []any{
+			map[string]any{"name": "john", "age": 2},
+			map[string]any{"name": "jane", "age": 5},
+			map[string]any{"name": "jill", "age": 8},
+		},
+		"a.b": "quoted",
 	}
 	fmt.Println(set(data, "name.hobbies[1]", "333333"))
 	fmt.Println(set(data, "age", 12))
@@ -33,41 +117,438 @@ func main() {
 	fmt.Println(get(data, "name.hobbies.car.foo"))
 	fmt.Println(set(data, "name.meta[].baz.far", "haha"))
 	fmt.Println(get(data, "age"))
+
+	fmt.Println(get(data, "name.hobbies[-1]"))
+	fmt.Println(get(data, "['a.b']"))
+	fmt.Println(get(data, "users[1:3].name"))
+	fmt.Println(get(data, "users[?(@.age > 3)].name"))
+	fmt.Println(get(data, "$..foo"))
+	fmt.Println(set(data, "name.meta[*].foo", "qux"))
+
+	ms, err := query(data, "users[?(@.name != 'jane')].age")
+	if err != nil {
+		fmt.Println(err)
+	}
+	for _, m := range ms {
+		fmt.Println(m.Path, m.Value)
+	}
 	fmt.Println(data)
+
+	payload := map[string]any{}
+	fmt.Println(set(payload, "a.b[3].c", 1))
+	fmt.Println(Append(payload, "a.tags", "x"))
+	fmt.Println(Append(payload, "a.tags", "y"))
+	fmt.Println(Delete(payload, "a.b[0]"))
+	fmt.Println(Move(payload, "a.tags", "tags"))
+	fmt.Println(Delete(payload, "a.c"))
+	fmt.Println(payload)
+
+	var patch []Operation
+	if err := json.Unmarshal([]byte(`[
+		{"op": "test", "path": "/users/0/name", "value": "john"},
+		{"op": "replace", "path": "/users/0/age", "value": 3},
+		{"op": "add", "path": "/users/-", "value": {"name": "jack", "age": 1}},
+		{"op": "copy", "from": "/users/0/name", "path": "/owner"},
+		{"op": "move", "from": "/a.b", "path": "/c~1d"},
+		{"op": "remove", "path": "/users/1"}
+	]`), &patch); err != nil {
+		fmt.Println(err)
+	}
+	before := clone(data)
+	fmt.Println(ApplyPatch(data, patch))
+	fmt.Println(ApplyPatch(data, []Operation{
+		{Op: "remove", Path: "/owner"},
+		{Op: "test", Path: "/owner", Value: "john"},
+	}))
+	fmt.Println(data["owner"])
+
+	b, _ := json.Marshal(Diff(before, data))
+	fmt.Println(string(b))
+
+	fmt.Println(MergePatch(data, map[string]any{"owner": nil, "name": map[string]any{"age": 2}}))
+	fmt.Println(CreateMergePatch(before, data))
+
+	cfg := &Config{
+		Name:   "api",
+		Limits: map[string]int{"rps": 10},
+	}
+	fmt.Println(set(cfg, "name", "worker"))
+	fmt.Println(set(cfg, "server.port", 8080.0))
+	fmt.Println(set(cfg, "server.hosts[1]", "b.local"))
+	fmt.Println(set(cfg, "limits.burst", 20))
+	fmt.Println(set(cfg, "replicas[0].weight", "heavy"))
+	fmt.Println(set(cfg, "replicas[0].weight", 2))
+	fmt.Println(get(cfg, "server.port"))
+	fmt.Println(get(cfg, "replicas[*].weight"))
+	fmt.Printf("%+v %+v\n", cfg, *cfg.Server)
+
+	weights := MustCompile("replicas[*].weight")
+	for range 3 {
+		fmt.Println(weights.Get(cfg))
+	}
+	fmt.Println(weights, weights.Query(cfg))
+
+	_, err = get(data, "users[9].name")
+	fmt.Println(err, errors.Is(err, ErrIndexOutOfRange))
+	err = set(cfg, "server.port", "http")
+	var pe *PathError
+	if errors.As(err, &pe) && errors.Is(err, ErrTypeMismatch) {
+		fmt.Printf("%s: %v (%s != %s)\n", pe.Path, pe.Segment, pe.Expected, pe.Actual)
+	}
 }
 
-func get(v any, path string) (any, error) {
+type Config struct {
+	Name     string         `json:"name"`
+	Server   *Server        `json:"server"`
+	Limits   map[string]int `json:"limits"`
+	Replicas []Replica      `json:"replicas"`
+}
+
+type Server struct {
+	Port  int      `json:"port"`
+	Hosts []string `json:"hosts"`
+}
+
+type Replica struct {
+	Weight int `json:"weight"`
+}
+
+// Path is a compiled path expression. It is immutable, so it can be reused
+// across calls and goroutines without parsing the path again.
+type Path struct {
+	expr  string
+	paths []any
+}
+
+// Compile parses the path once for repeated use.
+func Compile(path string) (Path, error) {
 	paths, err := parse(path)
+	if err != nil {
+		return Path{}, err
+	}
+
+	return Path{expr: path, paths: paths}, nil
+}
+
+// MustCompile is like Compile but panics if the path cannot be parsed.
+func MustCompile(path string) Path {
+	p, err := Compile(path)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func (p Path) String() string {
+	return p.expr
+}
+
+// compiled caches the paths used by the string-based API.
+var compiled = newPathCache(256)
+
+func compile(path string) (Path, error) {
+	if p, ok := compiled.get(path); ok {
+		return p, nil
+	}
+
+	p, err := Compile(path)
+	if err != nil {
+		return Path{}, err
+	}
+	compiled.add(path, p)
+
+	return p, nil
+}
+
+// pathCache is a small LRU cache of compiled paths.
+type pathCache struct {
+	mu  sync.Mutex
+	ll  *list.List
+	kv  map[string]*list.Element
+	cap int
+}
+
+func newPathCache(cap int) *pathCache {
+	return &pathCache{
+		ll:  list.New(),
+		kv:  make(map[string]*list.Element),
+		cap: cap,
+	}
+}
+
+func (c *pathCache) get(key string) (Path, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.kv[key]
+	if !ok {
+		return Path{}, false
+	}
+	c.ll.MoveToBack(el)
+
+	return el.Value.(Path), true
+}
+
+func (c *pathCache) add(key string, p Path) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.kv[key]; ok {
+		c.ll.MoveToBack(el)
+		return
+	}
+	c.kv[key] = c.ll.PushBack(p)
+	if c.ll.Len() > c.cap {
+		el := c.ll.Front()
+		c.ll.Remove(el)
+		delete(c.kv, el.Value.(Path).expr)
+	}
+}
+
+// get returns the value at the path. When the path may select more than one
+// value (wildcards, slices, filters or recursive descent), the matched values
+// are returned as a []any.
+func get(v any, path string) (any, error) {
+	p, err := compile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	for i, p := range paths {
-		v, err = getter(v, p)
+	return p.Get(v)
+}
+
+// set assigns the value at the path. Missing maps and slices along the path
+// are created, and slices are padded with nil to fit the index. When the path
+// may select more than one value, every match is assigned.
+func set(v any, path string, value any) error {
+	p, err := compile(path)
+	if err != nil {
+		return err
+	}
+
+	return p.Set(v, value)
+}
+
+// Delete removes the map key or slice element at the path. When the path may
+// select more than one value, every match is removed.
+func Delete(v any, path string) error {
+	p, err := compile(path)
+	if err != nil {
+		return err
+	}
+
+	return p.Delete(v)
+}
+
+// Append adds the value to the end of the slice at the path, creating the
+// slice if it does not exist.
+func Append(v any, path string, value any) error {
+	p, err := compile(path)
+	if err != nil {
+		return err
+	}
+
+	return p.Append(v, value)
+}
+
+// Move removes the value at from and sets it at to. Both paths must select a
+// single value.
+func Move(v any, from, to string) error {
+	src, err := compile(from)
+	if err != nil {
+		return err
+	}
+	dst, err := compile(to)
+	if err != nil {
+		return err
+	}
+
+	return src.Move(v, dst)
+}
+
+// query returns every value matched by the path together with its resolved
+// path.
+func query(v any, path string) ([]Match, error) {
+	p, err := compile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Query(v), nil
+}
+
+// Get is the compiled form of get.
+func (p Path) Get(v any) (any, error) {
+	if definite(p.paths) {
+		return resolve(v, p.paths)
+	}
+
+	var res []any
+	for _, m := range eval(v, p.paths) {
+		res = append(res, m.value)
+	}
+
+	return res, nil
+}
+
+// Set is the compiled form of set.
+func (p Path) Set(v any, value any) error {
+	ts := targets(v, p.paths)
+	if len(ts) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, p.expr)
+	}
+
+	for _, t := range ts {
+		err := apply(v, t, func(data, key any) (any, error) {
+			return setter(data, key, value)
+		})
 		if err != nil {
-			return nil, fmt.Errorf("%w: %s", err, buildKey(paths[:i+1]))
+			return err
 		}
 	}
 
-	return v, nil
+	return nil
 }
 
-func set(v any, path string, value any) error {
-	paths, err := parse(path)
+// Delete is the compiled form of Delete.
+func (p Path) Delete(v any) error {
+	ts := targets(v, p.paths)
+	if len(ts) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, p.expr)
+	}
+	for _, t := range ts {
+		if _, err := resolve(v, t); err != nil {
+			return err
+		}
+	}
+
+	// Remove the later elements first, so that the indices of the earlier
+	// ones stay valid.
+	sort.Slice(ts, func(i, j int) bool {
+		return comparePaths(ts[i], ts[j]) > 0
+	})
+	for _, t := range ts {
+		if err := apply(v, t, remover); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append is the compiled form of Append.
+func (p Path) Append(v any, value any) error {
+	ts := targets(v, p.paths)
+	if len(ts) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotFound, p.expr)
+	}
+
+	for _, t := range ts {
+		err := apply(v, t, func(data, key any) (any, error) {
+			s, err := getter(data, key)
+			if err != nil && !missing(data, key) {
+				return nil, err
+			}
+			if s == nil {
+				s = []any{}
+			}
+			if _, ok := s.([]any); !ok {
+				return nil, mismatch("slice", s)
+			}
+			return setter(data, key, append(s.([]any), value))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Move is the compiled form of Move.
+func (p Path) Move(v any, to Path) error {
+	src, dst := p.paths, to.paths
+	if len(src) == 0 || len(dst) == 0 {
+		return errors.New("empty path")
+	}
+	if !definite(src) {
+		return fmt.Errorf("%w: %s", errors.New("indefinite path"), p.expr)
+	}
+	if !definite(dst) {
+		return fmt.Errorf("%w: %s", errors.New("indefinite path"), to.expr)
+	}
+	if len(dst) > len(src) && comparePaths(src, dst[:len(src)]) == 0 {
+		return fmt.Errorf("%w: %s", errors.New("cannot move into itself"), to.expr)
+	}
+
+	value, err := resolve(v, src)
+	if err != nil {
+		return err
+	}
+	if err := apply(v, src, remover); err != nil {
+		return err
+	}
+
+	err = apply(v, dst, func(data, key any) (any, error) {
+		return setter(data, key, value)
+	})
 	if err != nil {
+		// Put the value back where it was, so that a failed move leaves the
+		// document unchanged.
+		apply(v, src, func(data, key any) (any, error) {
+			i, ok := key.(int)
+			s, isSlice := data.([]any)
+			if !ok || !isSlice {
+				return setter(data, key, value)
+			}
+			if i < 0 {
+				i += len(s) + 1
+			}
+			return slices.Insert(s, i, value), nil
+		})
 		return err
 	}
 
-	for i, p := range paths[:len(paths)-1] {
+	return nil
+}
+
+// Query is the compiled form of query.
+func (p Path) Query(v any) []Match {
+	var res []Match
+	for _, m := range eval(v, p.paths) {
+		res = append(res, Match{
+			Path:  buildKey(m.path),
+			Value: m.value,
+		})
+	}
+
+	return res
+}
+
+func resolve(v any, paths []any) (any, error) {
+	var err error
+	for i, p := range paths {
 		v, err = getter(v, p)
 		if err != nil {
-			return fmt.Errorf("%w: %s", err, buildKey(paths[:i+1]))
+			return nil, wrap(err, paths, i)
 		}
 	}
 
-	last := paths[len(paths)-1]
+	return v, nil
+}
+
+// definite reports whether the path selects at most one value.
+func definite(paths []any) bool {
+	for _, p := range paths {
+		switch p.(type) {
+		case string, int:
+		default:
+			return false
+		}
+	}
 
-	return setter(v, last, value)
+	return true
 }
 
 func getter(data any, key any) (any, error) {
@@ -75,7 +556,7 @@ func getter(data any, key any) (any, error) {
 	case string:
 		m, ok := data.(map[string]any)
 		if !ok {
-			return nil, errors.New("not a map")
+			return reflectGet(data, key)
 		}
 		value, ok := m[v]
 		if !ok {
@@ -85,105 +566,1570 @@ func getter(data any, key any) (any, error) {
 	case int:
 		s, ok := data.([]any)
 		if !ok {
-			return nil, errors.New("not a slice")
+			return reflectGet(data, key)
 		}
-		if len(s) < v {
-			return nil, errors.New("index out of range")
+		if v < 0 {
+			v += len(s)
 		}
-		return s[v], nil
-	case []int:
-		s, ok := data.([]any)
-		if !ok {
-			return nil, errors.New("not a slice")
+		if v < 0 || v >= len(s) {
+			return nil, ErrIndexOutOfRange
 		}
-		return s, nil
+		return s[v], nil
 	default:
 		return nil, errors.ErrUnsupported
 	}
 }
 
-func setter(data any, key any, value any) error {
+// setter assigns the value and returns the container, which is created when
+// data is nil and reallocated when a slice grows.
+func setter(data any, key any, value any) (any, error) {
 	switch v := key.(type) {
 	case string:
 		if d, ok := data.([]any); ok {
 			for _, dd := range d {
-				if err := setter(dd, key, value); err != nil {
-					return err
+				if _, err := setter(dd, key, value); err != nil {
+					return nil, err
 				}
 			}
-			return nil
+			return d, nil
 		}
 
+		if data == nil {
+			data = make(map[string]any)
+		}
 		m, ok := data.(map[string]any)
 		if !ok {
-			return errors.New("not a map")
+			return reflectSet(data, key, value)
 		}
 		m[v] = value
+		return m, nil
 	case int:
+		if data == nil {
+			data = []any{}
+		}
 		s, ok := data.([]any)
 		if !ok {
-			return errors.New("not a slice")
+			return reflectSet(data, key, value)
+		}
+		if v < 0 {
+			v += len(s)
+		}
+		if v < 0 {
+			return nil, ErrIndexOutOfRange
+		}
+		if v >= len(s) {
+			s = append(s, make([]any, v-len(s)+1)...)
 		}
 		s[v] = value
+		return s, nil
 	default:
-		return fmt.Errorf("unknown key: %T", key)
+		return nil, fmt.Errorf("unknown key: %T", key)
 	}
+}
 
-	return nil
+// remover deletes the key and returns the container. Slices are copied, so
+// that other references to the original slice are left intact.
+func remover(data any, key any) (any, error) {
+	switch v := key.(type) {
+	case string:
+		m, ok := data.(map[string]any)
+		if !ok {
+			return nil, mismatch("map", data)
+		}
+		if _, ok := m[v]; !ok {
+			return nil, ErrNotFound
+		}
+		delete(m, v)
+		return m, nil
+	case int:
+		s, ok := data.([]any)
+		if !ok {
+			return nil, mismatch("slice", data)
+		}
+		if v < 0 {
+			v += len(s)
+		}
+		if v < 0 || v >= len(s) {
+			return nil, ErrIndexOutOfRange
+		}
+		return append(s[:v:v], s[v+1:]...), nil
+	default:
+		return nil, fmt.Errorf("unknown key: %T", key)
+	}
 }
 
-func split(key string) ([]any, error) {
-	i := strings.Index(key, "[")
-	j := strings.Index(key, "]")
-	if i > -1 && i < j && j == len(key)-1 {
-		a := key[:i]
-		b := key[i+1 : j]
-		if b == "" {
-			return []any{a, []int{}}, nil
+// reflectGet reads struct fields by their json name, typed map keys and
+// typed slice elements, following pointers.
+func reflectGet(data any, key any) (any, error) {
+	rv := indirect(reflect.ValueOf(data))
+
+	switch k := key.(type) {
+	case string:
+		switch rv.Kind() {
+		case reflect.Struct:
+			idx, ok := field(rv.Type(), k)
+			if !ok {
+				return nil, ErrNotFound
+			}
+			f, err := rv.FieldByIndexErr(idx)
+			if err != nil {
+				return nil, ErrNotFound
+			}
+			return f.Interface(), nil
+		case reflect.Map:
+			mk, err := mapKey(k, rv.Type().Key())
+			if err != nil {
+				return nil, err
+			}
+			v := rv.MapIndex(mk)
+			if !v.IsValid() {
+				return nil, ErrNotFound
+			}
+			return v.Interface(), nil
 		}
-		n, err := strconv.Atoi(b)
-		if err != nil {
-			return nil, errors.New("invalid index")
+		return nil, mismatch("map", data)
+	case int:
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+			if k < 0 {
+				k += rv.Len()
+			}
+			if k < 0 || k >= rv.Len() {
+				return nil, ErrIndexOutOfRange
+			}
+			return rv.Index(k).Interface(), nil
+		}
+		return nil, mismatch("slice", data)
+	default:
+		return nil, errors.ErrUnsupported
+	}
+}
+
+// reflectSet assigns struct fields, typed map keys and typed slice elements,
+// converting the value to the target type. Values that are not addressable,
+// such as structs stored in a map, are copied, and the copy is returned for
+// the caller to store. Nil pointers, maps and slices are allocated.
+func reflectSet(data any, key any, value any) (any, error) {
+	rv := reflect.ValueOf(data)
+	if !rv.IsValid() {
+		return nil, errors.ErrUnsupported
+	}
+
+	ptr := rv.Kind() == reflect.Pointer
+	target := rv
+	if ptr {
+		if rv.IsNil() {
+			rv = reflect.New(rv.Type().Elem())
 		}
-		if strconv.Itoa(n) != b {
-			return nil, errors.New("invalid index")
+		target = rv.Elem()
+	}
+	if !target.CanAddr() && (target.Kind() == reflect.Struct || target.Kind() == reflect.Array) {
+		c := reflect.New(target.Type()).Elem()
+		c.Set(target)
+		target = c
+	}
+
+	switch k := key.(type) {
+	case string:
+		switch target.Kind() {
+		case reflect.Struct:
+			idx, ok := field(target.Type(), k)
+			if !ok {
+				return nil, ErrNotFound
+			}
+			f := fieldAlloc(target, idx)
+			cv, err := convert(value, f.Type())
+			if err != nil {
+				return nil, err
+			}
+			f.Set(cv)
+		case reflect.Map:
+			mk, err := mapKey(k, target.Type().Key())
+			if err != nil {
+				return nil, err
+			}
+			cv, err := convert(value, target.Type().Elem())
+			if err != nil {
+				return nil, err
+			}
+			if target.IsNil() {
+				target = reflect.MakeMap(target.Type())
+			}
+			target.SetMapIndex(mk, cv)
+		default:
+			return nil, mismatch("map", data)
 		}
-		if n < 0 {
-			return nil, errors.New("negative index")
+	case int:
+		switch target.Kind() {
+		case reflect.Slice, reflect.Array:
+			if k < 0 {
+				k += target.Len()
+			}
+			if k < 0 || (k >= target.Len() && target.Kind() == reflect.Array) {
+				return nil, ErrIndexOutOfRange
+			}
+			if k >= target.Len() {
+				target = reflect.AppendSlice(target, reflect.MakeSlice(target.Type(), k-target.Len()+1, k-target.Len()+1))
+			}
+			cv, err := convert(value, target.Type().Elem())
+			if err != nil {
+				return nil, err
+			}
+			target.Index(k).Set(cv)
+		default:
+			return nil, mismatch("slice", data)
 		}
+	default:
+		return nil, fmt.Errorf("unknown key: %T", key)
+	}
 
-		return []any{a, n}, nil
+	if ptr {
+		rv.Elem().Set(target)
+		return rv.Interface(), nil
 	}
 
-	return []any{key}, nil
+	return target.Interface(), nil
 }
 
-func parse(path string) ([]any, error) {
-	var paths []any
-	parts := strings.Split(path, ".")
-	for i, p := range parts {
-		part, err := split(p)
+// convert returns the value as type t. Numbers and strings are converted
+// between named and sized types when no precision is lost, and composite
+// values such as the maps produced by encoding/json are converted through a
+// JSON round trip.
+func convert(value any, t reflect.Type) (reflect.Value, error) {
+	if value == nil {
+		return reflect.Zero(t), nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Type().AssignableTo(t) {
+		return rv, nil
+	}
+
+	switch {
+	case t.Kind() == reflect.Pointer:
+		v, err := convert(value, t.Elem())
 		if err != nil {
-			key := strings.Join(parts[:i+1], ".")
-			return nil, fmt.Errorf("%w: %s", err, key)
+			return reflect.Value{}, err
+		}
+		p := reflect.New(t.Elem())
+		p.Elem().Set(v)
+		return p, nil
+	case isNumber(rv.Kind()) && isNumber(t.Kind()):
+		if rv.CanFloat() && !isFloat(t.Kind()) && (math.IsNaN(rv.Float()) || math.IsInf(rv.Float(), 0)) {
+			return reflect.Value{}, mismatch(t.String(), value)
 		}
-		paths = append(paths, part...)
+		// The round trip alone lets -1 through as the largest uint.
+		v := rv.Convert(t)
+		if sign(v) != sign(rv) || v.Convert(rv.Type()).Interface() != rv.Interface() {
+			return reflect.Value{}, mismatch(t.String(), value)
+		}
+		return v, nil
+	case rv.Kind() == reflect.String && t.Kind() == reflect.String:
+		return rv.Convert(t), nil
 	}
 
-	return paths, nil
+	b, err := json.Marshal(value)
+	if err != nil {
+		return reflect.Value{}, mismatch(t.String(), value)
+	}
+	p := reflect.New(t)
+	if err := json.Unmarshal(b, p.Interface()); err != nil {
+		return reflect.Value{}, mismatch(t.String(), value)
+	}
+
+	return p.Elem(), nil
+}
+
+func isNumber(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Float64
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+// sign returns -1, 0 or 1 for a number.
+func sign(v reflect.Value) int {
+	var f float64
+	switch {
+	case v.CanInt():
+		f = float64(v.Int())
+	case v.CanUint():
+		f = float64(v.Uint())
+	default:
+		f = v.Float()
+	}
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+func mapKey(key string, t reflect.Type) (reflect.Value, error) {
+	switch {
+	case t.Kind() == reflect.String:
+		return reflect.ValueOf(key).Convert(t), nil
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(key, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, mismatch(t.String(), key)
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uintptr:
+		n, err := strconv.ParseUint(key, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, mismatch(t.String(), key)
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("%w: map key %s", errors.ErrUnsupported, t)
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+// fields lists the exported struct fields by their json name, the way main.go
+// reads Tag.Get("json"). Fields of untagged embedded structs are promoted.
+func fields(t reflect.Type) []structField {
+	var res []structField
+	for _, f := range reflect.VisibleFields(t) {
+		tag := f.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && name == "" && indirectType(f.Type).Kind() == reflect.Struct {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		res = append(res, structField{name, f.Index})
+	}
+
+	return res
+}
+
+// field returns the index of the struct field with the json name. Like
+// encoding/json, an exact match is preferred over a case-insensitive one.
+func field(t reflect.Type, name string) ([]int, bool) {
+	var fold []int
+	for _, f := range fields(t) {
+		if f.name == name {
+			return f.index, true
+		}
+		if fold == nil && strings.EqualFold(f.name, name) {
+			fold = f.index
+		}
+	}
+
+	return fold, fold != nil
+}
+
+// fieldAlloc is FieldByIndex, but allocates nil embedded pointers.
+func fieldAlloc(v reflect.Value, idx []int) reflect.Value {
+	for i, x := range idx {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+
+	return v
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	return v
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	return t
+}
+
+// apply runs fn on the container holding the last key of the definite path,
+// creating missing containers on the way. The root cannot be replaced, so
+// operations that would resize a root slice fail.
+func apply(v any, paths []any, fn func(data, key any) (any, error)) error {
+	// The zero Path has no segments.
+	if len(paths) == 0 {
+		return errors.New("empty path")
+	}
+	if v == nil {
+		return fmt.Errorf("%w: %s", errors.New("nil document"), buildKey(paths[:1]))
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Struct || rv.Kind() == reflect.Array {
+		return fmt.Errorf("%w: %s", errors.New("cannot set on non-pointer root"), buildKey(paths[:1]))
+	}
+
+	res, err := update(v, paths, 0, fn)
+	if err != nil {
+		return err
+	}
+	if rv.Kind() == reflect.Slice && reflect.ValueOf(res).Len() != rv.Len() {
+		return fmt.Errorf("%w: %s", errors.New("cannot resize root slice"), buildKey(paths[:1]))
+	}
+
+	return nil
+}
+
+func update(data any, paths []any, i int, fn func(data, key any) (any, error)) (any, error) {
+	key := paths[i]
+	if i < len(paths)-1 {
+		child, err := getter(data, key)
+		if err != nil && !missing(data, key) {
+			return nil, wrap(err, paths, i)
+		}
+		if err != nil {
+			child = elemZero(data)
+		}
+		child, err = update(child, paths, i+1, fn)
+		if err != nil {
+			return nil, err
+		}
+		fn = func(data, key any) (any, error) {
+			return setter(data, key, child)
+		}
+	}
+
+	data, err := fn(data, key)
+	if err != nil {
+		return nil, wrap(err, paths, i)
+	}
+
+	return data, nil
+}
+
+// mismatch reports that the value is not of the expected kind. The path is
+// filled in by wrap.
+func mismatch(want string, got any) error {
+	actual := "null"
+	if got != nil {
+		actual = fmt.Sprintf("%T", got)
+	}
+
+	return &PathError{
+		Err:      ErrTypeMismatch,
+		Expected: want,
+		Actual:   actual,
+	}
+}
+
+// wrap records the failing segment paths[i] in err.
+func wrap(err error, paths []any, i int) error {
+	pe, ok := err.(*PathError)
+	if !ok {
+		pe = &PathError{Err: err}
+	}
+	pe.Path = buildKey(paths[:i+1])
+	pe.Segment = paths[i]
+	pe.Index = i
+
+	return pe
+}
+
+// missing reports whether the key can be created in data.
+func missing(data, key any) bool {
+	rv := reflect.ValueOf(data)
+	if !rv.IsValid() || rv.Kind() == reflect.Pointer && rv.IsNil() {
+		return true
+	}
+
+	rv = indirect(rv)
+	switch k := key.(type) {
+	case string:
+		return rv.Kind() == reflect.Map
+	case int:
+		return rv.Kind() == reflect.Slice && k >= rv.Len()
+	}
+
+	return false
+}
+
+// elemZero returns the zero value of the element type of a typed map or
+// slice, so that missing children are created with the right type.
+func elemZero(data any) any {
+	rv := reflect.ValueOf(data)
+	if !rv.IsValid() {
+		return nil
+	}
+
+	t := indirectType(rv.Type())
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice:
+		return reflect.Zero(t.Elem()).Interface()
+	}
+
+	return nil
+}
+
+// targets expands the indefinite part of the path against the document and
+// returns the definite paths it resolves to. The definite remainder of the
+// path is kept as is, so that it can be created.
+func targets(v any, paths []any) [][]any {
+	i := len(paths)
+	for i > 0 && definite(paths[i-1:i]) {
+		i--
+	}
+
+	var res [][]any
+	for _, m := range eval(v, paths[:i]) {
+		res = append(res, append(m.path[:len(m.path):len(m.path)], paths[i:]...))
+	}
+
+	return res
+}
+
+// comparePaths orders definite paths by key, with indices compared
+// numerically and parents before their children.
+func comparePaths(a, b []any) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch x := a[i].(type) {
+		case int:
+			if y, ok := b[i].(int); ok && x != y {
+				return x - y
+			}
+		case string:
+			if y, ok := b[i].(string); ok && x != y {
+				return strings.Compare(x, y)
+			}
+		}
+	}
+
+	return len(a) - len(b)
 }
 
+// eval applies each path segment to the current set of matches.
+func eval(v any, paths []any) []match {
+	ms := []match{{value: v}}
+	for _, p := range paths {
+		var next []match
+		for _, m := range ms {
+			next = append(next, selectKey(m, p)...)
+		}
+		ms = next
+	}
+
+	return ms
+}
+
+func selectKey(m match, key any) []match {
+	switch k := key.(type) {
+	case string:
+		v, err := getter(m.value, k)
+		if err != nil {
+			return nil
+		}
+		return []match{{extend(m.path, k), v}}
+	case int:
+		v, err := getter(m.value, k)
+		if err != nil {
+			return nil
+		}
+		if k < 0 {
+			k += indirect(reflect.ValueOf(m.value)).Len()
+		}
+		return []match{{extend(m.path, k), v}}
+	case wildcard:
+		return children(m)
+	case slice:
+		rv := indirect(reflect.ValueOf(m.value))
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil
+		}
+		var res []match
+		for _, i := range k.indices(rv.Len()) {
+			res = append(res, match{extend(m.path, i), rv.Index(i).Interface()})
+		}
+		return res
+	case filter:
+		var res []match
+		for _, c := range children(m) {
+			if k.match(c.value) {
+				res = append(res, c)
+			}
+		}
+		return res
+	case descent:
+		var res []match
+		walk(m, func(n match) {
+			res = append(res, selectKey(n, k.key)...)
+		})
+		return res
+	default:
+		return nil
+	}
+}
+
+// children returns the elements of a slice, the values of a map ordered by
+// key, or the fields of a struct in declaration order.
+func children(m match) []match {
+	var res []match
+	switch v := m.value.(type) {
+	case []any:
+		for i, e := range v {
+			res = append(res, match{extend(m.path, i), e})
+		}
+		return res
+	case map[string]any:
+		for _, k := range sortedKeys(v) {
+			res = append(res, match{extend(m.path, k), v[k]})
+		}
+		return res
+	}
+
+	rv := indirect(reflect.ValueOf(m.value))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := range rv.Len() {
+			res = append(res, match{extend(m.path, i), rv.Index(i).Interface()})
+		}
+	case reflect.Map:
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, k := range keys {
+			res = append(res, match{extend(m.path, fmt.Sprint(k)), rv.MapIndex(k).Interface()})
+		}
+	case reflect.Struct:
+		for _, f := range fields(rv.Type()) {
+			v, err := rv.FieldByIndexErr(f.index)
+			if err != nil {
+				continue
+			}
+			res = append(res, match{extend(m.path, f.name), v.Interface()})
+		}
+	}
+
+	return res
+}
+
+// walk visits the node and its descendants in pre-order. A node that is
+// one of its own ancestors, such as a struct pointing back to itself, is
+// skipped.
+func walk(m match, fn func(match)) {
+	walkFrom(m, fn, make(map[reference]bool))
+}
+
+func walkFrom(m match, fn func(match), ancestors map[reference]bool) {
+	ref, ok := referenceOf(m.value)
+	if ok {
+		if ancestors[ref] {
+			return
+		}
+		ancestors[ref] = true
+		defer delete(ancestors, ref)
+	}
+
+	fn(m)
+	for _, c := range children(m) {
+		walkFrom(c, fn, ancestors)
+	}
+}
+
+// reference identifies the pointer, map or slice that a value refers to.
+type reference struct {
+	t   reflect.Type
+	ptr uintptr
+}
+
+func referenceOf(v any) (reference, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if !rv.IsNil() {
+			return reference{rv.Type(), rv.Pointer()}, true
+		}
+	}
+	return reference{}, false
+}
+
+func extend(paths []any, key any) []any {
+	res := make([]any, len(paths), len(paths)+1)
+	copy(res, paths)
+	return append(res, key)
+}
+
+func (s slice) indices(n int) []int {
+	clamp := func(p *int, def int) int {
+		if p == nil {
+			return def
+		}
+		i := *p
+		if i < 0 {
+			i += n
+		}
+		if s.step > 0 {
+			return min(max(i, 0), n)
+		}
+		return min(max(i, -1), n-1)
+	}
+
+	var res []int
+	if s.step > 0 {
+		for i := clamp(s.start, 0); i < clamp(s.end, n); i += s.step {
+			res = append(res, i)
+		}
+	} else {
+		for i := clamp(s.start, n-1); i > clamp(s.end, -1); i += s.step {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+func (f filter) match(v any) bool {
+	for _, and := range f.or {
+		ok := true
+		for _, c := range and {
+			if !c.match(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c cond) match(v any) bool {
+	lhs, err := resolve(v, c.path)
+	if err != nil {
+		return false
+	}
+	if c.op == "" {
+		return true
+	}
+
+	return compare(lhs, c.op, c.value)
+}
+
+func compare(a any, op string, b any) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		}
+		return false
+	}
+
+	if x, ok := toString(a); ok {
+		y, ok := toString(b)
+		if !ok {
+			return op == "!="
+		}
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		case "<":
+			return x < y
+		case "<=":
+			return x <= y
+		case ">":
+			return x > y
+		case ">=":
+			return x >= y
+		}
+		return false
+	}
+
+	switch op {
+	case "==":
+		return reflect.DeepEqual(a, b)
+	case "!=":
+		return !reflect.DeepEqual(a, b)
+	}
+
+	return false
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch {
+	case !rv.IsValid():
+	case rv.CanInt():
+		return float64(rv.Int()), true
+	case rv.CanUint():
+		return float64(rv.Uint()), true
+	case rv.CanFloat():
+		return rv.Float(), true
+	}
+
+	return 0, false
+}
+
+func toString(v any) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.String {
+		return rv.String(), true
+	}
+
+	return "", false
+}
+
+// parse splits the path into segments. A segment is a string key, an int
+// index, or one of wildcard, slice, filter and descent.
+//
+//	$.a.b[0]        keys and indices, the leading $ is optional
+//	a[-1]           negative indices count from the end
+//	a['b.c']        quoted keys may contain dots
+//	a[*], a[], a.*  wildcards
+//	a[1:3:1]        slices
+//	a[?(@.b > 1)]   filters
+//	a..b            recursive descent
+func parse(path string) ([]any, error) {
+	s := strings.TrimPrefix(path, "$")
+	if s == "" && s == path {
+		return nil, errors.New("empty path")
+	}
+
+	var paths []any
+	for i := 0; i < len(s); {
+		deep := strings.HasPrefix(s[i:], "..")
+		switch {
+		case deep:
+			i += 2
+		case s[i] == '.':
+			i++
+		case i > 0 && s[i] != '[':
+			return nil, fmt.Errorf("%w: %s", errors.New("invalid path"), path)
+		}
+
+		var (
+			key any
+			n   int
+			err error
+		)
+		if i < len(s) && s[i] == '[' {
+			key, n, err = parseBracket(s[i:])
+		} else {
+			key, n, err = parseName(s[i:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, path[:len(path)-len(s)+min(i+n, len(s))])
+		}
+		i += n
+
+		if deep {
+			key = descent{key}
+		}
+		paths = append(paths, key)
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("empty path")
+	}
+
+	return paths, nil
+}
+
+func parseName(s string) (any, int, error) {
+	n := strings.IndexAny(s, ".[")
+	if n == -1 {
+		n = len(s)
+	}
+	if n == 0 {
+		return nil, 0, errors.New("empty key")
+	}
+	if s[:n] == "*" {
+		return wildcard{}, n, nil
+	}
+
+	return s[:n], n, nil
+}
+
+func parseBracket(s string) (any, int, error) {
+	j := closing(s)
+	if j == -1 {
+		return nil, len(s), errors.New("unclosed bracket")
+	}
+	b := strings.TrimSpace(s[1:j])
+	n := j + 1
+
+	switch {
+	case b == "" || b == "*":
+		return wildcard{}, n, nil
+	case b[0] == '\'' || b[0] == '"':
+		key, err := unquote(b)
+		if err != nil {
+			return nil, n, err
+		}
+		return key, n, nil
+	case b[0] == '?':
+		f, err := parseFilter(b)
+		if err != nil {
+			return nil, n, err
+		}
+		return f, n, nil
+	case strings.Contains(b, ":"):
+		sl, err := parseSlice(b)
+		if err != nil {
+			return nil, n, err
+		}
+		return sl, n, nil
+	}
+
+	i, err := strconv.Atoi(b)
+	if err != nil || strconv.Itoa(i) != b {
+		return nil, n, errors.New("invalid index")
+	}
+
+	return i, n, nil
+}
+
+// closing returns the index of the bracket that closes s[0], skipping quoted
+// strings.
+func closing(s string) int {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+func unquote(s string) (string, error) {
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return "", errors.New("invalid quoted key")
+	}
+
+	var sb strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s)-1 {
+			i++
+			c = s[i]
+		} else if c == s[0] || c == '\\' {
+			return "", errors.New("invalid quoted key")
+		}
+		sb.WriteByte(c)
+	}
+
+	return sb.String(), nil
+}
+
+func parseSlice(s string) (slice, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return slice{}, errors.New("invalid slice")
+	}
+
+	var nums [3]*int
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return slice{}, errors.New("invalid slice")
+		}
+		nums[i] = &n
+	}
+
+	step := 1
+	if nums[2] != nil {
+		step = *nums[2]
+	}
+	if step == 0 {
+		return slice{}, errors.New("zero slice step")
+	}
+
+	return slice{start: nums[0], end: nums[1], step: step}, nil
+}
+
+func parseFilter(s string) (filter, error) {
+	body := strings.TrimSpace(strings.TrimPrefix(s, "?"))
+	if !strings.HasPrefix(body, "(") || !strings.HasSuffix(body, ")") {
+		return filter{}, errors.New("invalid filter")
+	}
+
+	f := filter{expr: s}
+	for _, or := range splitOutside(body[1:len(body)-1], "||") {
+		var and []cond
+		for _, expr := range splitOutside(or, "&&") {
+			c, err := parseCond(strings.TrimSpace(expr))
+			if err != nil {
+				return filter{}, err
+			}
+			and = append(and, c)
+		}
+		f.or = append(f.or, and)
+	}
+
+	return f, nil
+}
+
+func parseCond(s string) (cond, error) {
+	lhs, op, rhs := s, "", ""
+	for _, o := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if parts := splitOutside(s, o); len(parts) == 2 {
+			lhs, op, rhs = strings.TrimSpace(parts[0]), o, strings.TrimSpace(parts[1])
+			break
+		}
+	}
+
+	if !strings.HasPrefix(lhs, "@") {
+		return cond{}, errors.New("invalid filter")
+	}
+
+	var c cond
+	if lhs != "@" {
+		paths, err := parse(lhs[1:])
+		if err != nil {
+			return cond{}, err
+		}
+		if !definite(paths) {
+			return cond{}, errors.New("invalid filter")
+		}
+		c.path = paths
+	}
+	if op == "" {
+		return c, nil
+	}
+
+	c.op = op
+	if strings.HasPrefix(rhs, "'") {
+		v, err := unquote(rhs)
+		if err != nil {
+			return cond{}, err
+		}
+		c.value = v
+		return c, nil
+	}
+	if err := json.Unmarshal([]byte(rhs), &c.value); err != nil {
+		return cond{}, errors.New("invalid filter")
+	}
+
+	return c, nil
+}
+
+// splitOutside splits s around sep, ignoring separators in quoted strings.
+func splitOutside(s, sep string) []string {
+	var (
+		res   []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(s[i:], sep):
+			// Do not split "<=" on "<" or "==" on "=".
+			if len(sep) == 1 && i+1 < len(s) && s[i+1] == '=' {
+				continue
+			}
+			res = append(res, s[start:i])
+			i += len(sep) - 1
+			start = i + 1
+		}
+	}
+
+	return append(res, s[start:])
+}
+
+// buildKey formats the segments as a path that parse accepts.
 func buildKey(parts []any) string {
 	var sb strings.Builder
 	for _, p := range parts {
 		switch v := p.(type) {
 		case string:
+			// A leading $ would be taken for the root, and @ or ? for a
+			// filter.
+			if v == "" || v == "*" || strings.ContainsAny(v, ".[]'\"\\ ") || strings.ContainsAny(v[:1], "$@?") {
+				sb.WriteString("['")
+				sb.WriteString(strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v))
+				sb.WriteString("']")
+				continue
+			}
+			if sb.Len() > 0 {
+				sb.WriteString(".")
+			}
 			sb.WriteString(v)
-			sb.WriteString(".")
 		case int:
+			sb.WriteString("[")
 			sb.WriteString(strconv.Itoa(v))
-			sb.WriteString(".")
+			sb.WriteString("]")
+		case wildcard:
+			sb.WriteString("[*]")
+		case slice:
+			sb.WriteString("[")
+			if v.start != nil {
+				sb.WriteString(strconv.Itoa(*v.start))
+			}
+			sb.WriteString(":")
+			if v.end != nil {
+				sb.WriteString(strconv.Itoa(*v.end))
+			}
+			if v.step != 1 {
+				sb.WriteString(":")
+				sb.WriteString(strconv.Itoa(v.step))
+			}
+			sb.WriteString("]")
+		case filter:
+			sb.WriteString("[")
+			sb.WriteString(v.expr)
+			sb.WriteString("]")
+		case descent:
+			sb.WriteString("..")
+			sb.WriteString(buildKey([]any{v.key}))
+		}
+	}
+	return sb.String()
+}
+
+// Operation is a single RFC 6902 JSON Patch operation. Paths are JSON
+// Pointers (RFC 6901), e.g. /users/0/name.
+type Operation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// MarshalJSON always writes the value of add, replace and test, which RFC
+// 6902 requires even when it is null.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	type operation Operation
+	switch o.Op {
+	case "add", "replace", "test":
+		return json.Marshal(struct {
+			operation
+			Value any `json:"value"`
+		}{operation(o), o.Value})
+	}
+	return json.Marshal(operation(o))
+}
+
+// ApplyPatch applies the JSON Patch to the document in place. The operations
+// run against a copy, so the document is only changed when all of them
+// succeed.
+func ApplyPatch(v any, patch []Operation) error {
+	doc := clone(v)
+	for _, op := range patch {
+		var err error
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+
+	return commit(v, doc)
+}
+
+func applyOperation(doc any, op Operation) (any, error) {
+	paths, err := pointer(doc, op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return patchAdd(doc, paths, clone(op.Value))
+	case "remove":
+		return patchRemove(doc, paths)
+	case "replace":
+		if _, err := resolve(doc, paths); err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return clone(op.Value), nil
+		}
+		return update(doc, paths, 0, func(data, key any) (any, error) {
+			return setter(data, key, clone(op.Value))
+		})
+	case "move", "copy":
+		from, err := pointer(doc, op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := resolve(doc, from)
+		if err != nil {
+			return nil, err
 		}
+		if op.Op == "copy" {
+			return patchAdd(doc, paths, clone(value))
+		}
+		if len(paths) >= len(from) && comparePaths(from, paths[:len(from)]) == 0 {
+			if len(paths) == len(from) {
+				return doc, nil
+			}
+			return nil, errors.New("cannot move into itself")
+		}
+		doc, err = patchRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// Removing the source may shift the target index.
+		paths, err = pointer(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(doc, paths, value)
+	case "test":
+		value, err := resolve(doc, paths)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(value, op.Value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown op: %s", op.Op)
+	}
+}
+
+// patchAdd inserts into slices and sets map keys. Unlike set, the parent must
+// already exist.
+func patchAdd(doc any, paths []any, value any) (any, error) {
+	if len(paths) == 0 {
+		return value, nil
+	}
+	if _, err := resolve(doc, paths[:len(paths)-1]); err != nil {
+		return nil, err
+	}
+
+	return update(doc, paths, 0, func(data, key any) (any, error) {
+		i, ok := key.(int)
+		if !ok {
+			return setter(data, key, value)
+		}
+		s, ok := data.([]any)
+		if !ok {
+			return nil, mismatch("slice", data)
+		}
+		if i > len(s) {
+			return nil, ErrIndexOutOfRange
+		}
+		return slices.Insert(s, i, value), nil
+	})
+}
+
+func patchRemove(doc any, paths []any) (any, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("cannot remove root")
+	}
+	if _, err := resolve(doc, paths); err != nil {
+		return nil, err
+	}
+
+	return update(doc, paths, 0, remover)
+}
+
+// Diff returns a JSON Patch that turns a into b.
+func Diff(a, b any) []Operation {
+	return diff("", a, b)
+}
+
+func diff(ptr string, a, b any) []Operation {
+	var ops []Operation
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		for _, k := range sortedKeys(x) {
+			p := ptr + "/" + escapePointer(k)
+			if _, ok := y[k]; !ok {
+				ops = append(ops, Operation{Op: "remove", Path: p})
+				continue
+			}
+			ops = append(ops, diff(p, x[k], y[k])...)
+		}
+		for _, k := range sortedKeys(y) {
+			if _, ok := x[k]; !ok {
+				ops = append(ops, Operation{Op: "add", Path: ptr + "/" + escapePointer(k), Value: clone(y[k])})
+			}
+		}
+		return ops
+	case []any:
+		y, ok := b.([]any)
+		if !ok {
+			break
+		}
+		for i := range min(len(x), len(y)) {
+			ops = append(ops, diff(ptr+"/"+strconv.Itoa(i), x[i], y[i])...)
+		}
+		for i := len(x) - 1; i >= len(y); i-- {
+			ops = append(ops, Operation{Op: "remove", Path: ptr + "/" + strconv.Itoa(i)})
+		}
+		for i := len(x); i < len(y); i++ {
+			ops = append(ops, Operation{Op: "add", Path: ptr + "/-", Value: clone(y[i])})
+		}
+		return ops
+	}
+
+	if equal(a, b) {
+		return nil
+	}
+
+	return []Operation{{Op: "replace", Path: ptr, Value: clone(b)}}
+}
+
+// MergePatch applies an RFC 7386 JSON Merge Patch to the document in place.
+// Null values in the patch remove the corresponding keys.
+func MergePatch(v any, patch any) error {
+	return commit(v, mergePatch(clone(v), patch))
+}
+
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return clone(patch)
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+
+	return t
+}
+
+// CreateMergePatch returns a JSON Merge Patch that turns a into b. Slices
+// are replaced as a whole, as the RFC requires.
+func CreateMergePatch(a, b any) any {
+	x, ok := a.(map[string]any)
+	if !ok {
+		return clone(b)
+	}
+	y, ok := b.(map[string]any)
+	if !ok {
+		return clone(b)
+	}
+
+	patch := make(map[string]any)
+	for k, xv := range x {
+		yv, ok := y[k]
+		if !ok {
+			patch[k] = nil
+			continue
+		}
+		if equal(xv, yv) {
+			continue
+		}
+		patch[k] = CreateMergePatch(xv, yv)
+	}
+	for k, yv := range y {
+		if _, ok := x[k]; !ok {
+			patch[k] = clone(yv)
+		}
+	}
+
+	return patch
+}
+
+// pointer converts the JSON Pointer into path segments. Tokens are indices
+// when the value they apply to is a slice, and "-" refers to the end of the
+// slice.
+func pointer(v any, ptr string) ([]any, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if ptr[0] != '/' {
+		return nil, fmt.Errorf("%w: %s", errors.New("invalid pointer"), ptr)
+	}
+
+	var paths []any
+	for _, tok := range strings.Split(ptr[1:], "/") {
+		tok = strings.NewReplacer("~1", "/", "~0", "~").Replace(tok)
+
+		var key any = tok
+		if s, ok := v.([]any); ok {
+			n, err := strconv.Atoi(tok)
+			switch {
+			case tok == "-":
+				n = len(s)
+			case err != nil || n < 0 || strconv.Itoa(n) != tok:
+				return nil, fmt.Errorf("%w: %s", errors.New("invalid index"), ptr)
+			}
+			key = n
+		}
+		paths = append(paths, key)
+		v, _ = getter(v, key)
+	}
+
+	return paths, nil
+}
+
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// commit copies the patched document into the original one. The root itself
+// cannot be replaced, so it must keep its type, and slices their length.
+func commit(v, doc any) error {
+	switch x := v.(type) {
+	case map[string]any:
+		y, ok := doc.(map[string]any)
+		if !ok {
+			return errors.New("cannot replace root")
+		}
+		clear(x)
+		maps.Copy(x, y)
+	case []any:
+		y, ok := doc.([]any)
+		if !ok || len(x) != len(y) {
+			return errors.New("cannot resize root slice")
+		}
+		copy(x, y)
+	default:
+		return errors.New("cannot replace root")
+	}
+
+	return nil
+}
+
+func clone(v any) any {
+	switch x := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(x))
+		for k, e := range x {
+			m[k] = clone(e)
+		}
+		return m
+	case []any:
+		s := make([]any, len(x))
+		for i, e := range x {
+			s[i] = clone(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// equal compares JSON values, treating numbers of different Go types as
+// equal when their values are.
+func equal(a, b any) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, xv := range x {
+			yv, ok := y[k]
+			if !ok || !equal(xv, yv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
-	return strings.TrimSuffix(sb.String(), ".")
+	sort.Strings(keys)
+	return keys
 }
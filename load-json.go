@@ -1,30 +1,797 @@
+// This program demonstrates how to load a file into a typed value, with the
+// decoder picked by the file extension:
+//
+//	.json    a single JSON document
+//	.ndjson  one JSON document per line, into a slice
+//	.yaml    a single YAML document, also .yml
+//	.toml    a single TOML document
+//
+// Unknown fields are rejected, so a typo in a field name fails the load
+// instead of silently leaving the field empty, and errors carry the line and
+// column of the problem.
+//
+// Files larger than memory are read one record at a time with Reader, from
+// either a top-level JSON array or newline-delimited JSON.
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUnknownExtension = errors.New("unknown file extension")
+	ErrTrailingData     = errors.New("trailing data after the document")
+	ErrRecordTooLarge   = errors.New("record too large")
 )
 
-func loadJSON(file string, obj interface{}) error {
-	body, err := ioutil.ReadFile(file)
+// LoadError is an error at a position of the loaded file. Line and Column
+// start at 1, and are 0 when the decoder does not report a position.
+type LoadError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *LoadError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+	if e.Column == 0 {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// Validator is implemented by types that check themselves after loading.
+type Validator interface {
+	Validate() error
+}
+
+// decoder decodes the file read from r into v, a pointer.
+type decoder func(r io.Reader, v any) error
+
+var decoders = map[string]decoder{
+	".json":   decodeJSON,
+	".ndjson": decodeNDJSON,
+	".yaml":   decodeYAML,
+	".yml":    decodeYAML,
+	".toml":   decodeTOML,
+}
+
+// Load decodes the file into a T. After decoding, T and the elements of a
+// slice T are validated if they implement Validator, and then the hooks run
+// in order. The first failure is returned, with the zero T.
+func Load[T any](file string, hooks ...func(T) error) (T, error) {
+	var res, zero T
+
+	dec, ok := decoders[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		return zero, fmt.Errorf("%w: %s", ErrUnknownExtension, file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return zero, err
+	}
+	defer f.Close()
+
+	if err := dec(bufio.NewReader(f), &res); err != nil {
+		var le *LoadError
+		var oe *offsetError
+		switch {
+		case errors.As(err, &le):
+			le.File = file
+			return zero, le
+		case errors.As(err, &oe):
+			le = &LoadError{File: file, Err: oe.err}
+			le.Line, le.Column, _ = locate(file, oe.offset)
+			return zero, le
+		}
+		return zero, &LoadError{File: file, Err: err}
+	}
+
+	if err := validate(&res); err != nil {
+		return zero, &LoadError{File: file, Err: err}
+	}
+	for _, hook := range hooks {
+		if err := hook(res); err != nil {
+			return zero, &LoadError{File: file, Err: err}
+		}
+	}
+
+	return res, nil
+}
+
+// validate runs Validate on the value v points to and, for a slice, on its
+// elements. Pointer receivers are found through the address, and nil
+// pointers are skipped.
+func validate(v any) error {
+	rv := reflect.ValueOf(v).Elem()
+	if err := validateValue(rv); err != nil {
+		return err
+	}
+
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := validateValue(rv.Index(i)); err != nil {
+			return fmt.Errorf("[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateValue(rv reflect.Value) error {
+	switch {
+	case rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+	case rv.CanAddr():
+		rv = rv.Addr()
+	}
+	if val, ok := rv.Interface().(Validator); ok {
+		return val.Validate()
+	}
+	return nil
+}
+
+// offsetError is an error at a byte offset of the file, turned into a line
+// and column by Load.
+type offsetError struct {
+	offset int64
+	err    error
+}
+
+func (e *offsetError) Error() string {
+	return e.err.Error()
+}
+
+// locate reads the file up to the offset, and returns its line and column,
+// 1-based.
+func locate(file string, offset int64) (line, column int, err error) {
+	f, err := os.Open(file)
 	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	line, column = 1, 1
+	br := bufio.NewReader(io.LimitReader(f, offset))
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return line, column, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if c == '\n' {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+}
+
+// offsetOf returns the offset reported by the JSON errors that carry one.
+// Others, such as unknown fields, are reported at the given offset.
+func offsetOf(err error, fallback int64) int64 {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		return syntax.Offset
+	case errors.As(err, &typ):
+		return typ.Offset
+	}
+	return fallback
+}
+
+// decodeJSON streams the document through a json.Decoder, and fails with
+// an offsetError. A top-level array decoded into a slice is read one element
+// at a time, so that errors without an offset point at their element rather
+// than at the end of the document.
+func decodeJSON(r io.Reader, v any) error {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	dec.DisallowUnknownFields()
+
+	var err error
+	if rv := reflect.ValueOf(v).Elem(); rv.Kind() == reflect.Slice && isArray(br) {
+		err = decodeArray(dec, rv)
+	} else if err = dec.Decode(v); err == io.EOF {
+		err = &offsetError{0, io.ErrUnexpectedEOF}
+	} else if err != nil {
+		err = &offsetError{offsetOf(err, dec.InputOffset()), err}
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return &offsetError{dec.InputOffset(), ErrTrailingData}
+	}
+	return nil
+}
+
+// isArray reports whether the next value of br is an array, without
+// consuming it.
+func isArray(br *bufio.Reader) bool {
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+		case '[':
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func decodeArray(dec *json.Decoder, rv reflect.Value) error {
+	fail := func(err error) error {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return &offsetError{offsetOf(err, dec.InputOffset()), err}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+	rv.Set(reflect.MakeSlice(rv.Type(), 0, 0))
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return fail(err)
+		}
+		start := dec.InputOffset() - int64(len(raw))
+		e := reflect.New(rv.Type().Elem())
+		if err := decodeValue(raw, e.Interface()); err != nil {
+			return &offsetError{start + offsetOf(err, 0), err}
+		}
+		rv.Set(reflect.Append(rv, e.Elem()))
+	}
+	if _, err := dec.Token(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// decodeValue decodes a single JSON value, rejecting unknown fields.
+func decodeValue(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if dec.More() {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// decodeNDJSON decodes each line into an element of the slice v points to.
+// Blank lines are skipped.
+func decodeNDJSON(r io.Reader, v any) error {
+	rv := reflect.ValueOf(v).Elem()
+	if rv.Kind() != reflect.Slice {
+		return fmt.Errorf("ndjson: want a slice, got %s", rv.Type())
+	}
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e := reflect.New(rv.Type().Elem())
+			if err := decodeValue(line, e.Interface()); err != nil {
+				return &LoadError{Line: n, Column: int(offsetOf(err, 0)) + 1, Err: err}
+			}
+			rv.Set(reflect.Append(rv, e.Elem()))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeYAML rejects unknown fields. The YAML errors already name the line.
+// decodeYAML reads the whole document, as the YAML parser does anyway, so
+// that the position of an error can be looked up in it.
+func decodeYAML(r io.Reader, v any) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF {
+			// An empty document, like an empty JSON file.
+			return io.ErrUnexpectedEOF
+		}
+		return yamlError(b, err)
+	}
+	if err := dec.Decode(new(yaml.Node)); err != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+var yamlLine = regexp.MustCompile(`line (\d+):`)
+
+// yamlError adds the position to a YAML error. yaml.v3 only reports the line,
+// in the message, so the column is that of the first node on the line.
+func yamlError(b []byte, err error) error {
+	msg := err.Error()
+	var te *yaml.TypeError
+	if errors.As(err, &te) && len(te.Errors) > 0 {
+		msg = te.Errors[0]
+	}
+	m := yamlLine.FindStringSubmatch(msg)
+	if m == nil {
 		return err
 	}
+	line, _ := strconv.Atoi(m[1])
+
+	var root yaml.Node
+	if yaml.Unmarshal(b, &root) != nil {
+		return &LoadError{Line: line, Err: err}
+	}
+	column := 0
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Line == line && (column == 0 || n.Column < column) {
+			column = n.Column
+		}
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(&root)
+	return &LoadError{Line: line, Column: column, Err: err}
+}
+
+func decodeTOML(r io.Reader, v any) error {
+	dec := toml.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+
+	var de *toml.DecodeError
+	if errors.As(err, &de) {
+		line, column := de.Position()
+		return &LoadError{Line: line, Column: column, Err: err}
+	}
+	var se *toml.StrictMissingError
+	if errors.As(err, &se) && len(se.Errors) > 0 {
+		line, column := se.Errors[0].Position()
+		return &LoadError{Line: line, Column: column, Err: err}
+	}
+	return err
+}
+
+// MalformedPolicy decides what Reader does with a record that cannot be
+// decoded into T.
+type MalformedPolicy int
+
+const (
+	// StopOnMalformed yields the error and stops.
+	StopOnMalformed MalformedPolicy = iota
+	// SkipMalformed drops the record and carries on.
+	SkipMalformed
+	// CollectMalformed drops the record, adds the error to Reader.Errors and
+	// carries on.
+	CollectMalformed
+)
+
+// Format is the layout of the input of Reader.
+type Format int
+
+const (
+	// DetectFormat reads a top-level array when the input starts with "[",
+	// and NDJSON otherwise. NDJSON whose records are arrays must be read
+	// with NDJSON.
+	DetectFormat Format = iota
+	// JSONArray reads the elements of a top-level JSON array.
+	JSONArray
+	// NDJSON reads one JSON value per line.
+	NDJSON
+)
+
+// RecordError is an error in the record starting at Offset.
+type RecordError struct {
+	Offset int64
+	Err    error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("record at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Reader decodes the records of a top-level JSON array, or of
+// newline-delimited JSON, one at a time, as set by Format. At most
+// MaxRecordSize bytes are held in memory, whatever the size of the input.
+//
+// Offset reports where the records read so far end. Reading can resume from
+// there later, by passing the offset to NewReader.
+type Reader[T any] struct {
+	// MaxRecordSize is the size of the largest record, 1 MiB by default.
+	// An NDJSON record over the limit is malformed. An array element over
+	// the limit ends the read, as the array cannot be resynchronised.
+	MaxRecordSize int
+	Format        Format
+	Malformed     MalformedPolicy
+	// Errors holds the malformed records with CollectMalformed.
+	Errors []*RecordError
+
+	r      io.Reader
+	offset int64
+}
+
+// NewReader reads the records of r, starting at the byte offset. The
+// offset must be 0, or one reported by Offset. If r is an io.Seeker it is
+// seeked there, otherwise the bytes before the offset are discarded.
+func NewReader[T any](r io.Reader, offset int64) *Reader[T] {
+	return &Reader[T]{
+		MaxRecordSize: 1 << 20,
+		r:             r,
+		offset:        offset,
+	}
+}
+
+// Offset returns the byte offset just after the last record read.
+func (r *Reader[T]) Offset() int64 {
+	return r.offset
+}
+
+// All returns an iterator over the records. Errors that end the read are
+// yielded last.
+func (r *Reader[T]) All() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		br, next, err := r.start()
+		switch {
+		case err != nil:
+			yield(zero, err)
+		case next == 0:
+		case r.array(next):
+			r.readArray(br, next, yield)
+		default:
+			r.readLines(br, yield)
+		}
+	}
+}
+
+// array reports whether to read a JSON array, given the next byte.
+func (r *Reader[T]) array(next byte) bool {
+	switch r.Format {
+	case JSONArray:
+		return true
+	case NDJSON:
+		return false
+	}
+	return next == '[' && r.offset == 0 || next == ',' || next == ']'
+}
+
+// start moves to the offset, and returns the next non-space byte without
+// consuming it, or 0 at the end of the input.
+func (r *Reader[T]) start() (*bufio.Reader, byte, error) {
+	if r.offset > 0 {
+		var err error
+		if s, ok := r.r.(io.Seeker); ok {
+			_, err = s.Seek(r.offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, r.r, r.offset)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	br := bufio.NewReaderSize(r.r, r.MaxRecordSize)
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err == io.EOF {
+			return br, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch c := b[n-1]; c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return br, c, nil
+		}
+	}
+}
+
+// malformed applies the policy to the error, and reports whether to carry
+// on.
+func (r *Reader[T]) malformed(yield func(T, error) bool, err *RecordError) bool {
+	switch r.Malformed {
+	case SkipMalformed:
+		return true
+	case CollectMalformed:
+		r.Errors = append(r.Errors, err)
+		return true
+	}
+	var zero T
+	yield(zero, err)
+	return false
+}
+
+func (r *Reader[T]) readLines(br *bufio.Reader, yield func(T, error) bool) {
+	var zero T
+	for {
+		start := r.offset
+		line, err := br.ReadSlice('\n')
+		r.offset += int64(len(line))
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				line, err = br.ReadSlice('\n')
+				r.offset += int64(len(line))
+			}
+			if err != nil && err != io.EOF {
+				yield(zero, &RecordError{start, err})
+				return
+			}
+			if !r.malformed(yield, &RecordError{start, ErrRecordTooLarge}) || err == io.EOF {
+				return
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			yield(zero, &RecordError{start, err})
+			return
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var v T
+			if derr := decodeValue(line, &v); derr != nil {
+				if !r.malformed(yield, &RecordError{start, derr}) {
+					return
+				}
+			} else if !yield(v, nil) {
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// readArray decodes the elements with json.Decoder.Token and More. When
+// resuming in the middle of the array, the separator is dropped and an
+// opening bracket is put in front, so that the decoder sees an array.
+func (r *Reader[T]) readArray(br *bufio.Reader, next byte, yield func(T, error) bool) {
+	var zero T
+
+	// base is the offset of the input that the decoder offsets start at.
+	base := r.offset
+	src := io.Reader(br)
+	if r.offset > 0 {
+		for {
+			c, err := br.ReadByte()
+			if err != nil {
+				yield(zero, &RecordError{base, err})
+				return
+			}
+			if c == ',' {
+				// The "[" below stands in for the comma.
+				break
+			}
+			if c == ']' {
+				// The decoder reads the bracket again, after a "[" that is
+				// not in the input.
+				br.UnreadByte()
+				base--
+				break
+			}
+			base++
+		}
+		src = io.MultiReader(strings.NewReader("["), br)
+	}
+
+	lr := &recordLimitReader{r: src}
+	dec := json.NewDecoder(lr)
+	fail := func(err error) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		yield(zero, &RecordError{r.offset, err})
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		fail(err)
+		return
+	}
+	if tok != json.Delim('[') {
+		yield(zero, &RecordError{r.offset, fmt.Errorf("want a JSON array, got %v", tok)})
+		return
+	}
+	for dec.More() {
+		lr.limit = dec.InputOffset() + int64(r.MaxRecordSize) + 1
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			fail(err)
+			return
+		}
+		end := dec.InputOffset()
+		start := base + end - int64(len(raw))
+		r.offset = base + end
+
+		var v T
+		if err := decodeValue(raw, &v); err != nil {
+			if !r.malformed(yield, &RecordError{start, err}) {
+				return
+			}
+		} else if !yield(v, nil) {
+			return
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		fail(err)
+		return
+	}
+	r.offset = base + dec.InputOffset()
+}
+
+// recordLimitReader fails with ErrRecordTooLarge when reading past the
+// limit, which is moved forward before each record.
+type recordLimitReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
 
-	return json.Unmarshal(body, &obj)
+func (l *recordLimitReader) Read(p []byte) (int, error) {
+	if l.limit > 0 {
+		if l.n >= l.limit {
+			return 0, ErrRecordTooLarge
+		}
+		if int64(len(p)) > l.limit-l.n {
+			p = p[:l.limit-l.n]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
 }
 
 // Point represents the schema of the json we want to load
 type Point struct {
-	X int `json:"x"`
-	Y int `json:"y"`
+	X int `json:"x" yaml:"x" toml:"x"`
+	Y int `json:"y" yaml:"y" toml:"y"`
+}
+
+func (p Point) Validate() error {
+	if p.X < 0 || p.Y < 0 {
+		return fmt.Errorf("point %v is outside the first quadrant", p)
+	}
+	return nil
 }
 
 func main() {
-	var points []Point
-	if err := loadJSON("out.json", &points); err != nil {
+	points, err := Load[[]Point]("out.json", func(points []Point) error {
+		if len(points) == 0 {
+			return errors.New("no points")
+		}
+		return nil
+	})
+	if err != nil {
 		log.Printf("error loading json: %v", err)
 	}
 	log.Printf("load json: %#v\n", points)
+
+	// A typo in a field name is an error rather than a zero value.
+	dir, err := os.MkdirTemp("", "load")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"typo.json":   "[\n  {\"x\": 1, \"y\": 2},\n  {\"x\": 1, \"why\": 2}\n]\n",
+		"bad.ndjson":  "{\"x\": 1, \"y\": 2}\n{\"x\": 1, \"y\": -2}\n",
+		"typo.yaml":   "- x: 1\n  y: 2\n- x: 1\n  why: 2\n",
+		"points.toml": "x = 1\ny = 2\n",
+		"typo.toml":   "x = 1\nwhy = 2\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, name := range []string{"typo.json", "bad.ndjson", "typo.yaml"} {
+		_, err := Load[[]Point](filepath.Join(dir, name))
+		log.Printf("load %s: %v", name, err)
+	}
+	for _, name := range []string{"points.toml", "typo.toml"} {
+		p, err := Load[Point](filepath.Join(dir, name))
+		log.Printf("load %s: %+v %v", name, p, err)
+	}
+
+	// Stream the records, collecting the malformed ones, and resume after
+	// the first record.
+	stream := "{\"x\": 1, \"y\": 1}\n{\"x\": 2, \"why\": 2}\n{\"x\": 3, \"y\": 3}\n{\"x\": 4,\n"
+	for _, input := range []string{stream, "[{\"x\": 1, \"y\": 1}, {\"x\": 2, \"why\": 2}, {\"x\": 3, \"y\": 3}]"} {
+		r := NewReader[Point](strings.NewReader(input), 0)
+		r.Malformed = CollectMalformed
+		var resume int64
+		for p, err := range r.All() {
+			if resume == 0 {
+				resume = r.Offset()
+			}
+			log.Printf("record: %+v %v", p, err)
+		}
+		log.Printf("malformed: %v", r.Errors)
+
+		for p, err := range NewReader[Point](strings.NewReader(input), resume).All() {
+			log.Printf("resumed at %d: %+v %v", resume, p, err)
+		}
+	}
+
+	// Records that are arrays themselves need the format set.
+	lines := NewReader[[]int](strings.NewReader("[1, 2]\n[3, 4]\n"), 0)
+	lines.Format = NDJSON
+	for p, err := range lines.All() {
+		log.Printf("ndjson record: %v %v", p, err)
+	}
+
+	// Resuming after the last record only reads the closing bracket.
+	input := "[{\"x\": 1, \"y\": 1}, {\"x\": 3, \"y\": 3}]"
+	var last int64
+	r := NewReader[Point](strings.NewReader(input), 0)
+	for range r.All() {
+		last = r.Offset()
+	}
+	r = NewReader[Point](strings.NewReader(input), last)
+	for p, err := range r.All() {
+		log.Printf("resumed at %d: %+v %v", last, p, err)
+	}
+	if r.Offset() != int64(len(input)) {
+		log.Fatalf("resumed at %d: offset %d, want %d", last, r.Offset(), len(input))
+	}
+	log.Printf("resumed at %d: offset %d", last, r.Offset())
 }
@@ -0,0 +1,367 @@
+// This program generates load against a URL and reports the throughput and
+// the latency distribution, like wrk, to compare servers such as
+// simplehttp.go and fasthttp.go without external tools:
+//
+//	go run load-test.go -c 10 -d 30s http://localhost:8080
+//	go run load-test.go -c 10 -n 100000 -format json http://localhost:8080
+//
+// Latencies are recorded in an HDR-style histogram, with a relative error
+// under 2% at every magnitude, so that the tail percentiles are accurate
+// without keeping every sample.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// subBits is the number of bits of precision kept in each power of two.
+const subBits = 6
+
+// Histogram counts values in log-linear buckets: values below 2^(subBits+1)
+// exactly, and larger ones in 2^subBits buckets per power of two.
+type Histogram struct {
+	counts []uint64
+	total  uint64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+func bucket(v int64) int {
+	if v < 1<<(subBits+1) {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBits - 1
+	return (shift+1)<<subBits + int(v>>shift) - 1<<subBits
+}
+
+// upper returns the largest value that falls in the bucket.
+func upper(i int) int64 {
+	if i < 1<<(subBits+1) {
+		return int64(i)
+	}
+	shift := i>>subBits - 1
+	sub := int64(i&(1<<subBits-1) + 1<<subBits)
+	return (sub+1)<<shift - 1
+}
+
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := bucket(v)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	h.max = max(h.max, v)
+	h.total++
+	h.sum += float64(v)
+}
+
+func (h *Histogram) Merge(o *Histogram) {
+	if o.total == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]uint64, len(o.counts)-len(h.counts))...)
+	}
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	if h.total == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sum += o.sum
+}
+
+// Percentile returns the value below which p percent of the values fall.
+func (h *Histogram) Percentile(p float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(h.total)))
+	rank = max(rank, 1)
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		if n >= rank {
+			return min(upper(i), h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / float64(h.total)
+}
+
+// Latency is the latency distribution in milliseconds.
+type Latency struct {
+	Min  float64 `json:"min_ms"`
+	Mean float64 `json:"mean_ms"`
+	P50  float64 `json:"p50_ms"`
+	P90  float64 `json:"p90_ms"`
+	P99  float64 `json:"p99_ms"`
+	P999 float64 `json:"p99_9_ms"`
+	Max  float64 `json:"max_ms"`
+}
+
+type Report struct {
+	URL         string         `json:"url"`
+	Connections int            `json:"connections"`
+	Workers     int            `json:"workers"`
+	Duration    float64        `json:"duration_s"`
+	Requests    uint64         `json:"requests"`
+	Throughput  float64        `json:"requests_per_s"`
+	Bytes       int64          `json:"bytes"`
+	Errors      uint64         `json:"errors"`
+	Status      map[string]int `json:"status"`
+	Latency     Latency        `json:"latency"`
+}
+
+type Config struct {
+	URL         string
+	Method      string
+	Body        string
+	Header      http.Header
+	Connections int
+	Workers     int
+	// Duration and Requests bound the run, whichever comes first. Zero means
+	// no bound, but at least one must be set.
+	Duration time.Duration
+	Requests int64
+	Timeout  time.Duration
+}
+
+// worker holds the results of one goroutine, merged at the end so that the
+// hot loop does not share memory.
+type worker struct {
+	hist   Histogram
+	bytes  int64
+	errors uint64
+	status map[int]int
+}
+
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Duration <= 0 && cfg.Requests <= 0 {
+		return nil, fmt.Errorf("set a duration or a number of requests")
+	}
+	if cfg.Connections <= 0 {
+		cfg.Connections = 1
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = cfg.Connections
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodGet
+	}
+
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: &http.Transport{
+			MaxConnsPerHost:     cfg.Connections,
+			MaxIdleConnsPerHost: cfg.Connections,
+			DisableCompression:  true,
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sent    atomic.Int64
+		workers = make([]*worker, cfg.Workers)
+		start   = time.Now()
+	)
+	for i := range workers {
+		w := &worker{status: make(map[int]int)}
+		workers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil && (cfg.Requests <= 0 || sent.Add(1) <= cfg.Requests) {
+				w.do(ctx, client, cfg)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var (
+		hist   Histogram
+		report = &Report{
+			URL:         cfg.URL,
+			Connections: cfg.Connections,
+			Workers:     cfg.Workers,
+			Duration:    elapsed.Seconds(),
+			Status:      make(map[string]int),
+		}
+	)
+	for _, w := range workers {
+		hist.Merge(&w.hist)
+		report.Bytes += w.bytes
+		report.Errors += w.errors
+		for code, n := range w.status {
+			report.Status[fmt.Sprint(code)] += n
+		}
+	}
+	report.Requests = hist.total
+	report.Throughput = float64(hist.total) / elapsed.Seconds()
+
+	ms := func(ns int64) float64 { return float64(ns) / 1e6 }
+	report.Latency = Latency{
+		Min:  ms(hist.min),
+		Mean: hist.Mean() / 1e6,
+		P50:  ms(hist.Percentile(50)),
+		P90:  ms(hist.Percentile(90)),
+		P99:  ms(hist.Percentile(99)),
+		P999: ms(hist.Percentile(99.9)),
+		Max:  ms(hist.max),
+	}
+
+	return report, nil
+}
+
+// do sends one request. Requests cut short by the end of the run are not
+// counted.
+func (w *worker) do(ctx context.Context, client *http.Client, cfg Config) {
+	var body io.Reader
+	if cfg.Body != "" {
+		body = strings.NewReader(cfg.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, cfg.Method, cfg.URL, body)
+	if err != nil {
+		w.errors++
+		return
+	}
+	for k, v := range cfg.Header {
+		req.Header[k] = v
+	}
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if err == nil {
+		var n int64
+		n, err = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		w.bytes += n
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		w.errors++
+		return
+	}
+	w.hist.Record(int64(time.Since(start)))
+	w.status[res.StatusCode]++
+}
+
+func (r *Report) WriteText(w io.Writer) error {
+	ms := func(v float64) time.Duration {
+		return time.Duration(v * 1e6).Round(time.Microsecond)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Running %.1fs test @ %s\n", r.Duration, r.URL)
+	fmt.Fprintf(tw, "  %d workers and %d connections\n", r.Workers, r.Connections)
+	fmt.Fprintf(tw, "  Latency\tmin\tmean\tp50\tp90\tp99\tp99.9\tmax\n")
+	l := r.Latency
+	fmt.Fprintf(tw, "\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", ms(l.Min), ms(l.Mean), ms(l.P50), ms(l.P90), ms(l.P99), ms(l.P999), ms(l.Max))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	codes := make([]string, 0, len(r.Status))
+	for code := range r.Status {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  Status %s: %d\n", code, r.Status[code])
+	}
+	fmt.Fprintf(w, "  %d requests in %.2fs, %.2fMB read, %d errors\n", r.Requests, r.Duration, float64(r.Bytes)/(1<<20), r.Errors)
+	fmt.Fprintf(w, "Requests/sec: %.2f\n", r.Throughput)
+	_, err := fmt.Fprintf(w, "Transfer/sec: %.2fMB\n", float64(r.Bytes)/(1<<20)/r.Duration)
+	return err
+}
+
+type headers http.Header
+
+func (h headers) String() string { return fmt.Sprint(http.Header(h)) }
+
+func (h headers) Set(s string) error {
+	k, v, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("want Name: value, got %q", s)
+	}
+	http.Header(h).Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	return nil
+}
+
+func main() {
+	cfg := Config{Header: make(http.Header)}
+	flag.IntVar(&cfg.Connections, "c", 10, "the number of connections")
+	flag.IntVar(&cfg.Workers, "w", 0, "the number of goroutines, defaults to the connections")
+	flag.DurationVar(&cfg.Duration, "d", 10*time.Second, "the duration of the run, 0 for no limit")
+	flag.Int64Var(&cfg.Requests, "n", 0, "the number of requests, 0 for no limit")
+	flag.DurationVar(&cfg.Timeout, "timeout", 5*time.Second, "the timeout of each request")
+	flag.StringVar(&cfg.Method, "m", http.MethodGet, "the method")
+	flag.StringVar(&cfg.Body, "body", "", "the request body")
+	flag.Var(headers(cfg.Header), "H", "a request header, repeatable")
+	format := flag.String("format", "text", "the report format, text or json")
+	flag.Parse()
+
+	cfg.URL = flag.Arg(0)
+	if cfg.URL == "" {
+		log.Fatal("usage: load-test [flags] url")
+	}
+
+	report, err := Run(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	case "text":
+		err = report.WriteText(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,341 @@
+// This program generates static mapping functions for the mapper prototypes,
+// so that hot paths do not go through reflection.
+//
+// Annotate the pairs to generate in the source file, and add a go:generate
+// directive:
+//
+//	//go:generate go run mapper-gen.go -in $GOFILE -out mappers_gen.go -register store
+//	//mapper:map *Hobby -> *HobbyAPI
+//	//mapper:map *UserEntity -> *UserAPI
+//
+// Fields are matched by name. A `mapper:"Name"` tag on the destination field
+// reads from another source field, and `mapper:"-"` skips it. Nested values
+// are mapped with the other generated functions, including slices, maps and
+// pointers of them. Destination fields without a source, and fields whose
+// types cannot be mapped, are reported as errors and nothing is written.
+//
+// The generated functions are registered with the -register function, e.g.
+// Register in 002-generic-mapper.go or store in 003-generic-api-mapper.go,
+// so that callers of Map and mapper do not change. Those still look the
+// mapper up and call it through reflection; hot paths should call the
+// generated mapXToY functions directly.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+func main() {
+	var (
+		in       = flag.String("in", os.Getenv("GOFILE"), "the annotated source file")
+		out      = flag.String("out", "", "the generated file, defaults to stdout")
+		register = flag.String("register", "Register", "the function that registers the mappers, empty to skip")
+	)
+	flag.Parse()
+
+	src, err := generate(*in, *register)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// pair is an annotated conversion between two named struct types, either
+// both by pointer or both by value.
+type pair struct {
+	from, to types.Type
+	name     string
+}
+
+type generator struct {
+	fset    *token.FileSet
+	pkg     *types.Package
+	pairs   []pair
+	imports map[string]bool
+	errs    []error
+	buf     bytes.Buffer
+}
+
+func generate(file, register string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	// The file may refer to previously generated code, so type errors are
+	// ignored as long as the annotated types resolve.
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		Error:    func(error) {},
+	}
+	pkg, _ := conf.Check(f.Name.Name, fset, []*ast.File{f}, nil)
+
+	g := &generator{
+		fset:    fset,
+		pkg:     pkg,
+		imports: make(map[string]bool),
+	}
+	g.readPairs(f)
+	if len(g.errs) > 0 {
+		return nil, errors.Join(g.errs...)
+	}
+
+	var body bytes.Buffer
+	for _, p := range g.pairs {
+		g.buf.Reset()
+		g.genPair(p)
+		body.Write(g.buf.Bytes())
+	}
+	if len(g.errs) > 0 {
+		return nil, errors.Join(g.errs...)
+	}
+
+	if register != "" {
+		fmt.Fprintf(&body, "func init() {\n")
+		for _, p := range g.pairs {
+			fmt.Fprintf(&body, "%s(%s)\n", register, p.name)
+		}
+		fmt.Fprintf(&body, "}\n")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by mapper-gen.go from %s; DO NOT EDIT.\n\n", file)
+	fmt.Fprintf(&buf, "package %s\n\n", f.Name.Name)
+	if len(g.imports) > 0 {
+		paths := make([]string, 0, len(g.imports))
+		for p := range g.imports {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		fmt.Fprintf(&buf, "import (\n")
+		for _, p := range paths {
+			fmt.Fprintf(&buf, "%q\n", p)
+		}
+		fmt.Fprintf(&buf, ")\n\n")
+	}
+	buf.Write(body.Bytes())
+
+	return format.Source(buf.Bytes())
+}
+
+// readPairs collects the //mapper:map annotations.
+func (g *generator) readPairs(f *ast.File) {
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			spec, ok := strings.CutPrefix(c.Text, "//mapper:map ")
+			if !ok {
+				continue
+			}
+			from, to, ok := strings.Cut(spec, "->")
+			if !ok {
+				g.errorf(c.Pos(), "want //mapper:map From -> To, got %s", c.Text)
+				continue
+			}
+			ft, err := g.lookup(strings.TrimSpace(from))
+			if err != nil {
+				g.errorf(c.Pos(), "%v", err)
+				continue
+			}
+			tt, err := g.lookup(strings.TrimSpace(to))
+			if err != nil {
+				g.errorf(c.Pos(), "%v", err)
+				continue
+			}
+			if isPointer(ft) != isPointer(tt) {
+				g.errorf(c.Pos(), "%s and %s must both be pointers or values", ft, tt)
+				continue
+			}
+			g.pairs = append(g.pairs, pair{
+				from: ft,
+				to:   tt,
+				name: "map" + g.typeName(ft) + "To" + g.typeName(tt),
+			})
+		}
+	}
+}
+
+// lookup resolves Name or *Name to a struct type of the package.
+func (g *generator) lookup(name string) (types.Type, error) {
+	base, ptr := strings.CutPrefix(name, "*")
+	obj := g.pkg.Scope().Lookup(base)
+	if obj == nil {
+		return nil, fmt.Errorf("type %s not found", base)
+	}
+	t := obj.Type()
+	if _, ok := t.Underlying().(*types.Struct); !ok {
+		return nil, fmt.Errorf("type %s is not a struct", base)
+	}
+	if ptr {
+		return types.NewPointer(t), nil
+	}
+	return t, nil
+}
+
+func (g *generator) genPair(p pair) {
+	from, to := p.from, p.to
+	if isPointer(from) {
+		from, to = deref(from), deref(to)
+	}
+	src := from.Underlying().(*types.Struct)
+	dst := to.Underlying().(*types.Struct)
+
+	fmt.Fprintf(&g.buf, "func %s(in %s) %s {\n", p.name, g.typeString(p.from), g.typeString(p.to))
+	if isPointer(p.from) {
+		fmt.Fprintf(&g.buf, "if in == nil {\nreturn nil\n}\n")
+		fmt.Fprintf(&g.buf, "out := new(%s)\n", g.typeString(to))
+	} else {
+		fmt.Fprintf(&g.buf, "var out %s\n", g.typeString(to))
+	}
+
+	for i := 0; i < dst.NumFields(); i++ {
+		f := dst.Field(i)
+		if !f.Exported() {
+			continue
+		}
+		name := f.Name()
+		if tag, ok := reflect.StructTag(dst.Tag(i)).Lookup("mapper"); ok {
+			if tag == "-" {
+				continue
+			}
+			name = tag
+		}
+
+		sf := field(src, name)
+		if sf == nil {
+			g.errorf(f.Pos(), "%s.%s: no field %s in %s", to, f.Name(), name, from)
+			continue
+		}
+		if err := g.assign("out."+f.Name(), "in."+sf.Name(), sf.Type(), f.Type(), 0); err != nil {
+			g.errorf(f.Pos(), "%s.%s: %v", to, f.Name(), err)
+		}
+	}
+	fmt.Fprintf(&g.buf, "return out\n}\n\n")
+}
+
+// assign writes the statements that set dst from src.
+func (g *generator) assign(dst, src string, st, dt types.Type, depth int) error {
+	if types.Identical(st, dt) {
+		fmt.Fprintf(&g.buf, "%s = %s\n", dst, src)
+		return nil
+	}
+	for _, p := range g.pairs {
+		if types.Identical(p.from, st) && types.Identical(p.to, dt) {
+			fmt.Fprintf(&g.buf, "%s = %s(%s)\n", dst, p.name, src)
+			return nil
+		}
+	}
+
+	sb, sok := st.Underlying().(*types.Basic)
+	db, dok := dt.Underlying().(*types.Basic)
+	if sok && dok && sb.Info() == db.Info() && types.ConvertibleTo(st, dt) {
+		fmt.Fprintf(&g.buf, "%s = %s(%s)\n", dst, g.typeString(dt), src)
+		return nil
+	}
+
+	i, v := fmt.Sprintf("i%d", depth), fmt.Sprintf("v%d", depth)
+	switch s := st.Underlying().(type) {
+	case *types.Slice:
+		d, ok := dt.Underlying().(*types.Slice)
+		if !ok {
+			break
+		}
+		fmt.Fprintf(&g.buf, "if %s != nil {\n", src)
+		fmt.Fprintf(&g.buf, "%s = make(%s, len(%s))\n", dst, g.typeString(dt), src)
+		fmt.Fprintf(&g.buf, "for %s, %s := range %s {\n", i, v, src)
+		if err := g.assign(fmt.Sprintf("%s[%s]", dst, i), v, s.Elem(), d.Elem(), depth+1); err != nil {
+			return err
+		}
+		fmt.Fprintf(&g.buf, "}\n}\n")
+		return nil
+	case *types.Map:
+		d, ok := dt.Underlying().(*types.Map)
+		if !ok || !types.Identical(s.Key(), d.Key()) {
+			break
+		}
+		fmt.Fprintf(&g.buf, "if %s != nil {\n", src)
+		fmt.Fprintf(&g.buf, "%s = make(%s, len(%s))\n", dst, g.typeString(dt), src)
+		fmt.Fprintf(&g.buf, "for %s, %s := range %s {\n", i, v, src)
+		fmt.Fprintf(&g.buf, "var m%d %s\n", depth, g.typeString(d.Elem()))
+		if err := g.assign(fmt.Sprintf("m%d", depth), v, s.Elem(), d.Elem(), depth+1); err != nil {
+			return err
+		}
+		fmt.Fprintf(&g.buf, "%s[%s] = m%d\n", dst, i, depth)
+		fmt.Fprintf(&g.buf, "}\n}\n")
+		return nil
+	case *types.Pointer:
+		d, ok := dt.Underlying().(*types.Pointer)
+		if !ok {
+			break
+		}
+		fmt.Fprintf(&g.buf, "if %s != nil {\n", src)
+		fmt.Fprintf(&g.buf, "%s := new(%s)\n", v, g.typeString(d.Elem()))
+		if err := g.assign("*"+v, "*"+src, s.Elem(), d.Elem(), depth+1); err != nil {
+			return err
+		}
+		fmt.Fprintf(&g.buf, "%s = %s\n}\n", dst, v)
+		return nil
+	}
+
+	return fmt.Errorf("cannot map %s to %s", g.typeString(st), g.typeString(dt))
+}
+
+func (g *generator) typeString(t types.Type) string {
+	return types.TypeString(t, func(p *types.Package) string {
+		if p == g.pkg {
+			return ""
+		}
+		g.imports[p.Path()] = true
+		return p.Name()
+	})
+}
+
+func (g *generator) typeName(t types.Type) string {
+	return deref(t).(*types.Named).Obj().Name()
+}
+
+func (g *generator) errorf(pos token.Pos, format string, args ...any) {
+	g.errs = append(g.errs, fmt.Errorf("%s: %s", g.fset.Position(pos), fmt.Sprintf(format, args...)))
+}
+
+func field(s *types.Struct, name string) *types.Var {
+	for i := 0; i < s.NumFields(); i++ {
+		if f := s.Field(i); f.Exported() && f.Name() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func isPointer(t types.Type) bool {
+	_, ok := t.(*types.Pointer)
+	return ok
+}
+
+func deref(t types.Type) types.Type {
+	if p, ok := t.(*types.Pointer); ok {
+		return p.Elem()
+	}
+	return t
+}
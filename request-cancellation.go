@@ -2,40 +2,269 @@ package main
 
 import (
 	"context"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
 	"time"
 )
 
-func main() {
+// RequestFunc builds the request to one backend. The request must use the
+// context, so that it is cancelled once another backend has answered.
+type RequestFunc func(ctx context.Context, backend string) (*http.Request, error)
+
+// Response is a response read in full, body included.
+type Response struct {
+	Backend    string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Latency    time.Duration
+}
+
+// Replicas sends a request to replicated backends, and returns the first
+// successful response, cancelling the others. A response is successful when
+// it is read in full with a status below 500.
+type Replicas struct {
+	Client   *http.Client
+	Backends []string
+
+	// Percentile of the latencies after which Hedge sends the next copy,
+	// 0.95 by default.
+	Percentile float64
+	// HedgeAfter is the delay used until enough latencies are recorded, 50ms
+	// by default.
+	HedgeAfter time.Duration
+
+	mu        sync.Mutex
+	latencies []time.Duration // the last successful latencies, a ring
+	next      int
+}
+
+const (
+	maxSamples = 256
+	minSamples = 16
+)
+
+// FanOut sends the request to every backend at once.
+func (r *Replicas) FanOut(ctx context.Context, fn RequestFunc) (*Response, error) {
+	return r.race(ctx, fn, false)
+}
+
+// Hedge sends the request to the backends in turn: the next one when the
+// previous has failed, or has not answered within the latency percentile.
+// This bounds the tail latency at the cost of a few extra requests.
+func (r *Replicas) Hedge(ctx context.Context, fn RequestFunc) (*Response, error) {
+	return r.race(ctx, fn, true)
+}
+
+type result struct {
+	res *Response
+	err error
+}
 
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+func (r *Replicas) race(ctx context.Context, fn RequestFunc, hedge bool) (*Response, error) {
+	if len(r.Backends) == 0 {
+		return nil, errors.New("no backends")
 	}
 
-	// Alternative:
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	// Cancelling the context on return stops the requests still running,
+	// including their body reads.
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	// ctx, cancel := context.WithCancel(context.Background())
-	// time.AfterFunc(2*time.Millisecond, cancel)
+
+	results := make(chan result, len(r.Backends))
+	sent, pending := 0, 0
+	send := func() {
+		backend := r.Backends[sent]
+		sent++
+		pending++
+		go func() {
+			res, err := r.fetch(ctx, fn, backend)
+			results <- result{res, err}
+		}()
+	}
+
+	send()
+	for !hedge && sent < len(r.Backends) {
+		send()
+	}
+
+	var timer <-chan time.Time
+	if hedge && sent < len(r.Backends) {
+		timer = time.After(r.delay())
+	}
+
+	var errs []error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.res, nil
+			}
+			errs = append(errs, res.err)
+			if hedge && sent < len(r.Backends) {
+				send()
+				timer = nil
+				if sent < len(r.Backends) {
+					timer = time.After(r.delay())
+				}
+			}
+		case <-timer:
+			send()
+			timer = nil
+			if sent < len(r.Backends) {
+				timer = time.After(r.delay())
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (r *Replicas) fetch(ctx context.Context, fn RequestFunc, backend string) (*Response, error) {
+	start := time.Now()
+	req, err := fn(ctx, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// The body read fails as soon as the context is cancelled.
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", backend, err)
+	}
+	if res.StatusCode >= 500 {
+		return nil, fmt.Errorf("%s: %s", backend, res.Status)
+	}
+
+	latency := time.Since(start)
+	r.record(latency)
+
+	return &Response{
+		Backend:    backend,
+		StatusCode: res.StatusCode,
+		Header:     res.Header,
+		Body:       body,
+		Latency:    latency,
+	}, nil
+}
+
+func (r *Replicas) record(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.latencies) < maxSamples {
+		r.latencies = append(r.latencies, d)
+		return
+	}
+	r.latencies[r.next] = d
+	r.next = (r.next + 1) % maxSamples
+}
+
+// delay returns the latency percentile of the recent requests.
+func (r *Replicas) delay() time.Duration {
+	r.mu.Lock()
+	samples := slices.Clone(r.latencies)
+	r.mu.Unlock()
+
+	if len(samples) < minSamples {
+		if r.HedgeAfter > 0 {
+			return r.HedgeAfter
+		}
+		return 50 * time.Millisecond
+	}
+
+	p := r.Percentile
+	if p <= 0 || p > 1 {
+		p = 0.95
+	}
+	slices.Sort(samples)
+	return samples[min(int(p*float64(len(samples))), len(samples)-1)]
+}
+
+func main() {
+	backend := func(name string, latency time.Duration, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			select {
+			case <-time.After(latency):
+			case <-req.Context().Done():
+				log.Printf("%s: cancelled", name)
+				return
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "hello from %s", name)
+		}))
+	}
+	slow := backend("slow", 300*time.Millisecond, http.StatusOK)
+	fast := backend("fast", 10*time.Millisecond, http.StatusOK)
+	broken := backend("broken", 0, http.StatusInternalServerError)
+	for _, s := range []*httptest.Server{slow, fast, broken} {
+		defer s.Close()
+	}
+
+	get := func(ctx context.Context, backend string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, backend+"/lookup", nil)
+	}
+
+	r := &Replicas{
+		Client:   &http.Client{Timeout: 5 * time.Second},
+		Backends: []string{slow.URL, broken.URL, fast.URL},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	req, err := http.NewRequest("GET", "http://www.google.com", nil)
+	res, err := r.FanOut(ctx, get)
 	if err != nil {
 		log.Fatal(err)
 	}
-	req = req.WithContext(ctx)
+	log.Printf("fan out: %s in %s", res.Body, res.Latency.Round(time.Millisecond))
 
-	res, err := client.Do(req)
+	// The slow backend is asked first, and hedged after 50ms; the broken one
+	// fails straight away, so the fast one is asked next.
+	start := time.Now()
+	res, err = r.Hedge(ctx, get)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("hedge: %s in %s", res.Body, time.Since(start).Round(time.Millisecond))
 
-	b, err := ioutil.ReadAll(res.Body)
+	// When the failures reach the last backend, there is nothing left to
+	// hedge with, and the slow one answers.
+	last := &Replicas{
+		Client:     r.Client,
+		Backends:   []string{broken.URL, broken.URL, slow.URL},
+		HedgeAfter: 20 * time.Millisecond,
+	}
+	res, err = last.Hedge(ctx, get)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("hedge to the last backend: %s", res.Body)
+
+	// A deadline shorter than every backend cancels all the requests.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err = r.FanOut(ctx, get)
+	log.Printf("deadline: %v", err)
 
-	log.Println(string(b))
+	// Let the servers log the cancellations.
+	time.Sleep(50 * time.Millisecond)
 }
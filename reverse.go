@@ -1,12 +1,34 @@
 // This program demonstrates how to reverse string in go
+//
+// Reversing the runes breaks the characters made of several runes: "é" as
+// e and a combining accent, emoji joined with ZWJ such as 👩‍💻, and flags
+// made of two regional indicators. The functions here work on extended
+// grapheme clusters, as segmented by UAX #29, which is what users see as one
+// character, and measure them in terminal columns for fixed-width output.
 package main
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
 
 func main() {
-	log.Println(reverse("hello world!"))
+	for _, s := range []string{"hello world!", "café", "👩‍💻 and 🇯🇵", "Zoë 王小明"} {
+		log.Printf("%q: runes %q, graphemes %q, len %d, width %d", s, reverse(s), Reverse(s), Len(s), Width(s))
+	}
+
+	// Names in a fixed-width table.
+	names := []string{"John", "王小明", "José Ramón Fernández", "👨‍👩‍👧‍👦 family", "Zoë"}
+	for _, name := range names {
+		fmt.Printf("| %s | %2d |\n", Pad(Truncate(name, 12, "…"), 12), Width(name))
+	}
 }
 
+// reverse reverses the runes, which is only correct for text where every
+// character is a single rune.
 func reverse(s string) string {
 	r := []rune(s)
 	for i, j := 0, len(r)-1; i < len(r)/2; i, j = i+1, j-1 {
@@ -14,3 +36,68 @@ func reverse(s string) string {
 	}
 	return string(r)
 }
+
+// graphemes returns the grapheme clusters of s.
+func graphemes(s string) []string {
+	var res []string
+	g := uniseg.NewGraphemes(s)
+	for g.Next() {
+		res = append(res, g.Str())
+	}
+	return res
+}
+
+// Reverse reverses the grapheme clusters of s, keeping each one intact.
+func Reverse(s string) string {
+	gs := graphemes(s)
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := len(gs) - 1; i >= 0; i-- {
+		b.WriteString(gs[i])
+	}
+	return b.String()
+}
+
+// Len returns the number of grapheme clusters of s.
+func Len(s string) int {
+	return uniseg.GraphemeClusterCount(s)
+}
+
+// Width returns the number of terminal columns s takes: 2 for wide East
+// Asian characters and emoji, 0 for control and zero-width characters.
+func Width(s string) int {
+	return uniseg.StringWidth(s)
+}
+
+// Truncate shortens s to at most n columns, without splitting a grapheme
+// cluster. When s is cut, the ellipsis is appended and counts towards n.
+func Truncate(s string, n int, ellipsis string) string {
+	if Width(s) <= n {
+		return s
+	}
+	n -= Width(ellipsis)
+	if n < 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	g := uniseg.NewGraphemes(s)
+	for g.Next() {
+		w := g.Width()
+		if w > n {
+			break
+		}
+		n -= w
+		b.WriteString(g.Str())
+	}
+	b.WriteString(ellipsis)
+	return b.String()
+}
+
+// Pad appends spaces to s up to n columns.
+func Pad(s string, n int) string {
+	if w := Width(s); w < n {
+		return s + strings.Repeat(" ", n-w)
+	}
+	return s
+}
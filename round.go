@@ -1,24 +1,191 @@
-// This program demonstrates how to round numbers in golang
+// This program demonstrates how to round numbers in golang, to decimal
+// places or significant figures, with the usual rounding modes.
+//
+// Rounding is done exactly on big.Rat. A float64 is rounded as the shortest
+// decimal that prints as it, so 2.675 is a tie like it reads, even though
+// the float is slightly below 2.675.
 
 package main
 
 import (
+	"fmt"
 	"log"
 	"math"
+	"math/big"
+	"strconv"
 )
 
-func round(val float64) float64 {
-	_, v := math.Modf(val)
-	if math.Abs(v) >= .5 {
-		if val >= 0 {
-			return math.Ceil(val)
+// Mode decides which way a value between two rounded values goes.
+type Mode int
+
+const (
+	// HalfAwayFromZero rounds to the nearest, and ties away from zero.
+	HalfAwayFromZero Mode = iota
+	// HalfTowardZero rounds to the nearest, and ties towards zero.
+	HalfTowardZero
+	// HalfEven rounds to the nearest, and ties to the even digit, also known
+	// as banker's rounding.
+	HalfEven
+	// HalfOdd rounds to the nearest, and ties to the odd digit.
+	HalfOdd
+	// HalfCeiling rounds to the nearest, and ties towards positive infinity.
+	HalfCeiling
+	// HalfFloor rounds to the nearest, and ties towards negative infinity.
+	HalfFloor
+	// Ceiling rounds towards positive infinity.
+	Ceiling
+	// Floor rounds towards negative infinity.
+	Floor
+	// Truncate rounds towards zero.
+	Truncate
+)
+
+// HalfUp and HalfDown are the names of Java's RoundingMode and Python's
+// decimal module.
+const (
+	HalfUp   = HalfAwayFromZero
+	HalfDown = HalfTowardZero
+)
+
+var modeNames = [...]string{"half-away-from-zero", "half-toward-zero", "half-even", "half-odd", "half-ceiling", "half-floor", "ceiling", "floor", "truncate"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+	return modeNames[m]
+}
+
+// RoundRat rounds x to the decimal places, which are negative to round to
+// tens, hundreds and so on.
+func RoundRat(x *big.Rat, places int, mode Mode) *big.Rat {
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(places))), nil))
+	y := new(big.Rat)
+	if places >= 0 {
+		y.Mul(x, scale)
+	} else {
+		y.Quo(x, scale)
+	}
+
+	// y = q + r, with q truncated towards zero and |r| < 1.
+	q, m := new(big.Int).QuoRem(y.Num(), y.Denom(), new(big.Int))
+	r := new(big.Rat).SetFrac(m, y.Denom())
+	if r.Sign() != 0 {
+		var up bool // whether |q| moves away from zero
+		half := new(big.Rat).Abs(r).Cmp(big.NewRat(1, 2))
+		neg := y.Sign() < 0
+		switch mode {
+		case Ceiling:
+			up = !neg
+		case Floor:
+			up = neg
+		case Truncate:
+			up = false
+		default:
+			switch {
+			case half > 0:
+				up = true
+			case half < 0:
+				up = false
+			case mode == HalfAwayFromZero:
+				up = true
+			case mode == HalfTowardZero:
+				up = false
+			case mode == HalfEven:
+				up = q.Bit(0) == 1
+			case mode == HalfOdd:
+				up = q.Bit(0) == 0
+			case mode == HalfCeiling:
+				up = !neg
+			case mode == HalfFloor:
+				up = neg
+			}
+		}
+		if up {
+			q.Add(q, big.NewInt(int64(y.Sign())))
 		}
-		return math.Floor(val)
 	}
-	if val >= 0 {
-		return math.Floor(val)
+
+	res := new(big.Rat).SetInt(q)
+	if places >= 0 {
+		return res.Quo(res, scale)
+	}
+	return res.Mul(res, scale)
+}
+
+// RoundRatSig rounds x to the significant figures.
+func RoundRatSig(x *big.Rat, digits int, mode Mode) *big.Rat {
+	if x.Sign() == 0 {
+		return new(big.Rat)
+	}
+	return RoundRat(x, digits-1-exponent(x), mode)
+}
+
+// exponent returns e such that 10^e <= |x| < 10^(e+1).
+func exponent(x *big.Rat) int {
+	a := new(big.Rat).Abs(x)
+	// The digit counts give the exponent up to one, even outside the range
+	// of float64.
+	e := len(a.Num().String()) - len(a.Denom().String())
+
+	pow := func(e int) *big.Rat {
+		p := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(e))), nil)
+		if e < 0 {
+			return new(big.Rat).SetFrac(big.NewInt(1), p)
+		}
+		return new(big.Rat).SetInt(p)
+	}
+	for a.Cmp(pow(e)) < 0 {
+		e--
+	}
+	for a.Cmp(pow(e+1)) >= 0 {
+		e++
+	}
+	return e
+}
+
+// ParseDecimal parses an exact decimal, such as "2.675" or "-1e-3".
+func ParseDecimal(s string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", s)
 	}
-	return math.Ceil(val)
+	return r, nil
+}
+
+// Round rounds x to the decimal places. NaN and infinities are returned as
+// is, and the sign of zero is kept.
+func Round(x float64, places int, mode Mode) float64 {
+	return roundFloat(x, func(r *big.Rat) *big.Rat {
+		return RoundRat(r, places, mode)
+	})
+}
+
+// RoundSig rounds x to the significant figures.
+func RoundSig(x float64, digits int, mode Mode) float64 {
+	return roundFloat(x, func(r *big.Rat) *big.Rat {
+		return RoundRatSig(r, digits, mode)
+	})
+}
+
+func roundFloat(x float64, fn func(*big.Rat) *big.Rat) float64 {
+	if x == 0 || math.IsNaN(x) || math.IsInf(x, 0) {
+		return x
+	}
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(x, 'g', -1, 64))
+	f, _ := fn(r).Float64()
+	return math.Copysign(f, x)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func round(val float64) float64 {
+	return Round(val, 0, HalfAwayFromZero)
 }
 
 func main() {
@@ -28,4 +195,97 @@ func main() {
 	log.Println(round(-0.5))
 	log.Println(round(0.5))
 	log.Println(round(0.4))
+
+	// Known edge cases, checked for every mode. want is in the order of the
+	// modes: away from zero, toward zero, even, odd, half ceiling, half floor,
+	// ceiling, floor, truncate.
+	negZero := math.Copysign(0, -1)
+	tests := []struct {
+		x      float64
+		places int
+		sig    bool
+		want   [9]float64
+	}{
+		{2.675, 2, false, [9]float64{2.68, 2.67, 2.68, 2.67, 2.68, 2.67, 2.68, 2.67, 2.67}},
+		{-2.675, 2, false, [9]float64{-2.68, -2.67, -2.68, -2.67, -2.67, -2.68, -2.67, -2.68, -2.67}},
+		{1.005, 2, false, [9]float64{1.01, 1, 1, 1.01, 1.01, 1, 1.01, 1, 1}},
+		{0.5, 0, false, [9]float64{1, 0, 0, 1, 1, 0, 1, 0, 0}},
+		{-0.5, 0, false, [9]float64{-1, negZero, negZero, -1, negZero, -1, negZero, -1, negZero}},
+		{1.5, 0, false, [9]float64{2, 1, 2, 1, 2, 1, 2, 1, 1}},
+		{2.5, 0, false, [9]float64{3, 2, 2, 3, 3, 2, 3, 2, 2}},
+		{-2.5, 0, false, [9]float64{-3, -2, -2, -3, -2, -3, -2, -3, -2}},
+		{-0.4, 0, false, [9]float64{negZero, negZero, negZero, negZero, negZero, negZero, negZero, -1, negZero}},
+		{123.54, 0, false, [9]float64{124, 124, 124, 124, 124, 124, 124, 123, 123}},
+		{1250, -2, false, [9]float64{1300, 1200, 1200, 1300, 1300, 1200, 1300, 1200, 1200}},
+		{123456, 2, true, [9]float64{120000, 120000, 120000, 120000, 120000, 120000, 130000, 120000, 120000}},
+		{0.00123456, 3, true, [9]float64{0.00123, 0.00123, 0.00123, 0.00123, 0.00123, 0.00123, 0.00124, 0.00123, 0.00123}},
+		{9.995, 3, true, [9]float64{10, 9.99, 10, 9.99, 10, 9.99, 10, 9.99, 9.99}},
+		{-1000, 1, true, [9]float64{-1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000}},
+	}
+	failed := 0
+	for _, tt := range tests {
+		for m, want := range tt.want {
+			mode := Mode(m)
+			var got float64
+			if tt.sig {
+				got = RoundSig(tt.x, tt.places, mode)
+			} else {
+				got = Round(tt.x, tt.places, mode)
+			}
+			if got != want || math.Signbit(got) != math.Signbit(want) {
+				failed++
+				log.Printf("FAIL round(%v, %d, sig=%t, %s) = %v, want %v", tt.x, tt.places, tt.sig, mode, got, want)
+			}
+		}
+	}
+
+	// Exact decimals do not go through float64 at all.
+	// Significant figures work outside the range of float64 too.
+	rats := []struct {
+		x      string
+		places int
+		sig    bool
+		mode   Mode
+		want   string
+	}{
+		{"2.675", 2, false, HalfEven, "2.68"},
+		{"2.665", 2, false, HalfEven, "2.66"},
+		{"-0.5", 0, false, HalfEven, "0"},
+		{"1/3", 5, false, HalfUp, "0.33333"},
+		{"2/3", 3, false, Truncate, "0.666"},
+		{"-2/3", 3, false, Floor, "-0.667"},
+		{"0.125", 2, false, HalfOdd, "0.13"},
+		{"-2.675", 2, false, HalfDown, "-2.67"},
+		{"-2.665", 2, false, HalfUp, "-2.67"},
+		{"100000000000000000000000.5", 0, false, HalfEven, "100000000000000000000000"},
+		{"1e400", 2, true, HalfEven, "1e400"},
+		{"1e-400", 2, true, HalfEven, "1e-400"},
+		{"-1.25e400", 2, true, HalfEven, "-1.2e400"},
+		{"9.95e-400", 2, true, HalfUp, "1e-399"},
+	}
+	for _, tt := range rats {
+		x, err := ParseDecimal(tt.x)
+		if err != nil {
+			log.Fatal(err)
+		}
+		want, err := ParseDecimal(tt.want)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var got *big.Rat
+		if tt.sig {
+			got = RoundRatSig(x, tt.places, tt.mode)
+		} else {
+			got = RoundRat(x, tt.places, tt.mode)
+		}
+		if got.Cmp(want) != 0 {
+			failed++
+			log.Printf("FAIL round(%s, %d, sig=%t, %s) = %s, want %s", tt.x, tt.places, tt.sig, tt.mode, got.RatString(), tt.want)
+		}
+	}
+
+	if failed > 0 {
+		log.Fatalf("%d rounding checks failed", failed)
+	}
+	log.Printf("%d rounding checks passed", len(tests)*len(modeNames)+len(rats))
 }
@@ -1,26 +1,312 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-func main() {
-	// c := &http.Client{
-	// 	Timeout: 15 * time.Second,
-	// }
-	// resp, err := c.Get("http://www.google.com")
-
-	c := &http.Client{
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second, // limits the time spent establishing a TCP connection (if a new one is needed).
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout:   10 * time.Second, // limits the time spent performing the TLS handshake.
-			ResponseHeaderTimeout: 10 * time.Second, // limits the time spent reading the headers of the response.
-			ExpectContinueTimeout: 1 * time.Second,  // limits the time the client will wait between sending the request headers when including an Expect: 100-continue and receiving the go-ahead to send the body
+// Timings are the durations of the phases of one attempt. DNS, Connect and
+// TLS are zero when a pooled connection is reused.
+type Timings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// TTFB is the time from the start of the attempt to the first byte of
+	// the response.
+	TTFB   time.Duration
+	Reused bool
+}
+
+type options struct {
+	timeout   time.Duration
+	dialer    net.Dialer
+	transport *http.Transport
+
+	retries   int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	trace func(*http.Request, Timings)
+}
+
+type Option func(*options)
+
+// Timeout limits the time of a whole call, retries included. Use the
+// request context for per-request deadlines.
+func Timeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// DialTimeout limits the time spent establishing a TCP connection, if a new
+// one is needed.
+func DialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialer.Timeout = d
+	}
+}
+
+// TLSHandshakeTimeout limits the time spent performing the TLS handshake.
+func TLSHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.transport.TLSHandshakeTimeout = d
+	}
+}
+
+// ResponseHeaderTimeout limits the time spent reading the headers of the
+// response.
+func ResponseHeaderTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.transport.ResponseHeaderTimeout = d
+	}
+}
+
+// IdleConnTimeout limits the time an idle connection stays in the pool.
+func IdleConnTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.transport.IdleConnTimeout = d
+	}
+}
+
+// Pool sizes the connection pool: idle connections in total and per host,
+// and connections per host, 0 for no limit.
+func Pool(maxIdle, maxIdlePerHost, maxPerHost int) Option {
+	return func(o *options) {
+		o.transport.MaxIdleConns = maxIdle
+		o.transport.MaxIdleConnsPerHost = maxIdlePerHost
+		o.transport.MaxConnsPerHost = maxPerHost
+	}
+}
+
+// Retries retries idempotent requests up to n times on network errors and on
+// 429, 502, 503 and 504 responses. The delay doubles from base up to max,
+// with jitter, unless the response has a Retry-After header.
+func Retries(n int, base, max time.Duration) Option {
+	return func(o *options) {
+		o.retries = n
+		o.baseDelay = base
+		o.maxDelay = max
+	}
+}
+
+// Trace calls fn with the timings of every attempt.
+func Trace(fn func(*http.Request, Timings)) Option {
+	return func(o *options) {
+		o.trace = fn
+	}
+}
+
+// NewClient returns a client with timeouts on every phase. Without options
+// it does not retry.
+func NewClient(opts ...Option) *http.Client {
+	o := &options{
+		timeout: 30 * time.Second,
+		dialer: net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   10,
 		},
+		baseDelay: 100 * time.Millisecond,
+		maxDelay:  10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.transport.DialContext = o.dialer.DialContext
+
+	var rt http.RoundTripper = o.transport
+	if o.trace != nil {
+		rt = &traceTransport{next: rt, fn: o.trace}
+	}
+	if o.retries > 0 {
+		rt = &retryTransport{next: rt, options: o}
 	}
+
+	return &http.Client{
+		Timeout:   o.timeout,
+		Transport: rt,
+	}
+}
+
+type traceTransport struct {
+	next http.RoundTripper
+	fn   func(*http.Request, Timings)
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		tm                               Timings
+		start                            = time.Now()
+		dnsStart, connectStart, tlsStart time.Time
+	)
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { tm.DNS = time.Since(dnsStart) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { tm.Connect = time.Since(connectStart) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { tm.TLS = time.Since(tlsStart) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			tm.Reused = info.Reused
+		},
+		GotFirstResponseByte: func() { tm.TTFB = time.Since(start) },
+	}
+
+	res, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	t.fn(req, tm)
+	return res, err
+}
+
+type retryTransport struct {
+	next http.RoundTripper
+	*options
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !retryable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		res, err := t.next.RoundTrip(req)
+		if attempt == t.retries || !shouldRetry(req.Context(), res, err) {
+			return res, err
+		}
+
+		delay := t.backoff(attempt, res)
+		if res != nil {
+			// Drain the body so that the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryable reports whether the request can be sent again: its method is
+// idempotent, or it has an Idempotency-Key, and its body can be rewound.
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func shouldRetry(ctx context.Context, res *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff returns a delay between half and all of the exponential delay,
+// so that clients failing together do not retry together.
+func (t *retryTransport) backoff(attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && s >= 0 {
+			return min(time.Duration(s)*time.Second, t.maxDelay)
+		}
+	}
+
+	d := t.maxDelay
+	if attempt < 32 {
+		d = min(t.baseDelay<<attempt, t.maxDelay)
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func main() {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "hello world")
+	}))
+	defer srv.Close()
+
+	c := NewClient(
+		Timeout(15*time.Second),
+		DialTimeout(5*time.Second),
+		Pool(100, 10, 0),
+		Retries(3, 50*time.Millisecond, time.Second),
+		Trace(func(r *http.Request, t Timings) {
+			log.Printf("%s %s: %+v", r.Method, r.URL, t)
+		}),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s after %d calls: %s", res.Status, calls.Load(), body)
+
+	// A deadline shorter than the backoff stops the retries.
+	calls.Store(-10)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	_, err = c.Do(req)
+	log.Printf("deadline: %v, canceled: %t", err, errors.Is(err, context.DeadlineExceeded))
 }
@@ -1,23 +1,220 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
-func main() {
-	// The default listenAndServe does not enforce timeout, and should
-	// be avoided in production
-	// http.ListenAndServe(":8080")
+//
+// The default http.ListenAndServe does not enforce timeouts, and should be
+// avoided in production. Enforcing timeouts on client connections helps
+// prevent leaking file descriptors:
+//
+//	http: Accept error: accept tcp [::]:80: accept4: too many open files; retrying in 5ms
+
+// Check reports whether a dependency of the server, such as a database, is
+// usable.
+type Check func(context.Context) error
+
+// Config is the server configuration. The zero value of a field means its
+// default, see DefaultConfig.
+type Config struct {
+	Addr string
+
+	// ReadHeaderTimeout limits the time to read the request headers, and
+	// ReadTimeout the time to read the whole request.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// WriteTimeout limits the time from the end of the request headers to
+	// the end of the response.
+	WriteTimeout time.Duration
+	// IdleTimeout limits the time to wait for the next request on a
+	// keep-alive connection.
+	IdleTimeout    time.Duration
+	MaxHeaderBytes int
+
+	// DrainDelay is the time between failing readiness and shutting down,
+	// for load balancers to stop sending requests.
+	DrainDelay time.Duration
+	// ShutdownTimeout limits the time to wait for requests in flight.
+	ShutdownTimeout time.Duration
+
+	// Checks are run by the readiness endpoint, by name.
+	Checks map[string]Check
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Addr:              ":8080",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		DrainDelay:        5 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+	}
+}
+
+// withDefaults fills the zero fields with the defaults. A negative
+// DrainDelay disables the delay.
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+	if c.Addr == "" {
+		c.Addr = d.Addr
+	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = d.ReadHeaderTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = d.ReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = d.WriteTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = d.IdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = d.MaxHeaderBytes
+	}
+	if c.DrainDelay == 0 {
+		c.DrainDelay = d.DrainDelay
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = d.ShutdownTimeout
+	}
+	return c
+}
+
+// Run serves the handler until the context is done or the process receives
+// SIGINT or SIGTERM. It then fails readiness, waits for the drain delay, and
+// shuts down, waiting for the requests in flight up to the shutdown timeout.
+// A second signal kills the process.
+//
+// The handler is served next to the /livez and /readyz endpoints: liveness
+// succeeds while the process serves, and readiness while it is not shutting
+// down and all the checks pass.
+func Run(ctx context.Context, cfg Config, h http.Handler) error {
+	cfg = cfg.withDefaults()
+
+	var ready atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if err := check(r.Context(), cfg.Checks); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/", h)
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	srv := &http.Server{
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:              cfg.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		BaseContext:       func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
+	}
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on %s", ln.Addr())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+	ready.Store(true)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Restore the default handling, so that a second signal kills the
+	// process.
+	stop()
+	log.Printf("shutting down, draining for %s", cfg.DrainDelay)
+	ready.Store(false)
+	if cfg.DrainDelay > 0 {
+		time.Sleep(cfg.DrainDelay)
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
-	log.Println("listening to port *:8080. press ctrl + c to cancel.")
-	log.Fatal(srv.ListenAndServe(":8080"))
+	log.Println("server stopped")
 
-	// Enforcing timeouts on client connections helps prevent leaking file descriptors:
-	// http: Accept error: accept tcp [::]:80: accept4: too many open files; retrying in 5ms
+	return nil
+}
+
+// check runs the checks in name order, and returns the failures.
+func check(ctx context.Context, checks map[string]Check) error {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func main() {
+	cfg := DefaultConfig()
+	cfg.Checks = map[string]Check{
+		"clock": func(context.Context) error {
+			if time.Now().Year() < 2000 {
+				return errors.New("clock is not set")
+			}
+			return nil
+		},
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello world")
+	})
+	log.Println("press ctrl + c to stop.")
+	if err := Run(context.Background(), cfg, h); err != nil {
+		log.Fatal(err)
+	}
 }
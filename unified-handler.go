@@ -0,0 +1,339 @@
+// This program mounts the same handlers on net/http and on fasthttp, so that
+// hot endpoints can move to fasthttp without rewriting them.
+//
+//	go run unified-handler.go -http :8080 -fasthttp :8081
+//	curl localhost:8081/users/42?verbose=1
+//
+// Handlers see a Context with accessors for the request and the response,
+// and are routed by a Router that serves both.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Context is one call to a handler, whichever server runs it. Headers must
+// be set before the first Write.
+type Context interface {
+	context.Context
+
+	Method() string
+	Path() string
+	Query(key string) string
+	Header(key string) string
+	// Param returns the value of a :name segment of the route.
+	Param(name string) string
+	Body() ([]byte, error)
+
+	SetHeader(key, value string)
+	SetStatus(code int)
+	Write(p []byte) (int, error)
+}
+
+type Handler func(Context) error
+
+type Middleware func(Handler) Handler
+
+// Error is an error with an HTTP status. Handlers return it to answer with
+// the status, and the message as the body; other errors answer 500.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// JSON writes v as the JSON response.
+func JSON(c Context, code int, v any) error {
+	c.SetHeader("Content-Type", "application/json")
+	c.SetStatus(code)
+	return json.NewEncoder(c).Encode(v)
+}
+
+type httpContext struct {
+	context.Context
+	w      http.ResponseWriter
+	r      *http.Request
+	params map[string]string
+	status int
+	wrote  bool
+}
+
+func (c *httpContext) Method() string           { return c.r.Method }
+func (c *httpContext) Path() string             { return c.r.URL.Path }
+func (c *httpContext) Query(key string) string  { return c.r.URL.Query().Get(key) }
+func (c *httpContext) Header(key string) string { return c.r.Header.Get(key) }
+func (c *httpContext) Param(name string) string { return c.params[name] }
+func (c *httpContext) Body() ([]byte, error)    { return io.ReadAll(c.r.Body) }
+
+func (c *httpContext) SetHeader(key, value string) { c.w.Header().Set(key, value) }
+func (c *httpContext) SetStatus(code int)          { c.status = code }
+
+func (c *httpContext) Write(p []byte) (int, error) {
+	if !c.wrote {
+		c.wrote = true
+		c.w.WriteHeader(c.status)
+	}
+	return c.w.Write(p)
+}
+
+// fastContext wraps the fasthttp.RequestCtx, which is a context.Context
+// itself. It must not be kept after the handler returns.
+type fastContext struct {
+	*fasthttp.RequestCtx
+	params map[string]string
+}
+
+func (c *fastContext) Method() string           { return string(c.RequestCtx.Method()) }
+func (c *fastContext) Path() string             { return string(c.RequestCtx.Path()) }
+func (c *fastContext) Query(key string) string  { return string(c.QueryArgs().Peek(key)) }
+func (c *fastContext) Header(key string) string { return string(c.Request.Header.Peek(key)) }
+func (c *fastContext) Param(name string) string { return c.params[name] }
+func (c *fastContext) Body() ([]byte, error)    { return c.PostBody(), nil }
+
+func (c *fastContext) SetHeader(key, value string) { c.Response.Header.Set(key, value) }
+func (c *fastContext) SetStatus(code int)          { c.SetStatusCode(code) }
+
+type route struct {
+	method   string
+	segments []string
+	handler  Handler
+}
+
+// match returns the :name parameters if the path matches the route.
+func (rt *route) match(path []string) (map[string]string, bool) {
+	if len(path) != len(rt.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range rt.segments {
+		if name, ok := strings.CutPrefix(s, ":"); ok {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[name] = path[i]
+			continue
+		}
+		if s != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Router routes by method and path, with :name segments for parameters. It
+// serves both net/http, as an http.Handler, and fasthttp.
+type Router struct {
+	routes     []*route
+	middleware []Middleware
+}
+
+// Use adds middleware, run in order around every handler, including the
+// 404 and 405 answers.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+func (r *Router) Handle(method, pattern string, h Handler) {
+	r.routes = append(r.routes, &route{
+		method:   method,
+		segments: split(pattern),
+		handler:  h,
+	})
+}
+
+func split(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// lookup returns the handler and the parameters for the request, wrapped in
+// the middleware.
+func (r *Router) lookup(method, path string) (Handler, map[string]string) {
+	var (
+		h       Handler
+		params  map[string]string
+		allowed []string
+	)
+	segments := split(path)
+	for _, rt := range r.routes {
+		p, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if rt.method != method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		h, params = rt.handler, p
+		break
+	}
+
+	if h == nil {
+		h = func(c Context) error {
+			return &Error{http.StatusNotFound, "not found"}
+		}
+		if len(allowed) > 0 {
+			h = func(c Context) error {
+				c.SetHeader("Allow", strings.Join(allowed, ", "))
+				return &Error{http.StatusMethodNotAllowed, "method not allowed"}
+			}
+		}
+	}
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h, params
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h, params := r.lookup(req.Method, req.URL.Path)
+	c := &httpContext{
+		Context: req.Context(),
+		w:       w,
+		r:       req,
+		params:  params,
+		status:  http.StatusOK,
+	}
+	err := h(c)
+	switch {
+	case err == nil && !c.wrote:
+		// A status without a body, such as 204.
+		w.WriteHeader(c.status)
+	case err != nil && c.wrote:
+		log.Printf("%s %s: %v", req.Method, req.URL.Path, err)
+	case err != nil:
+		code, msg := status(err)
+		http.Error(w, msg, code)
+	}
+}
+
+func (r *Router) ServeFastHTTP(ctx *fasthttp.RequestCtx) {
+	h, params := r.lookup(string(ctx.Method()), string(ctx.Path()))
+	if err := h(&fastContext{ctx, params}); err != nil {
+		// fasthttp buffers the response, so the body can still be replaced.
+		// The headers are kept, like http.Error does.
+		code, msg := status(err)
+		ctx.ResetBody()
+		ctx.SetStatusCode(code)
+		ctx.SetContentType("text/plain; charset=utf-8")
+		ctx.SetBodyString(msg + "\n")
+	}
+}
+
+func status(err error) (int, string) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code, e.Message
+	}
+	return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+}
+
+// Logger logs every call with its duration.
+func Logger(next Handler) Handler {
+	return func(c Context) error {
+		start := time.Now()
+		err := next(c)
+		log.Printf("%s %s %s %v", c.Method(), c.Path(), time.Since(start), err)
+		return err
+	}
+}
+
+// Recover turns panics into 500 answers.
+func Recover(next Handler) Handler {
+	return func(c Context) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		return next(c)
+	}
+}
+
+type User struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// The business logic only knows about Context.
+
+func getUser(c Context) error {
+	if c.Param("id") == "0" {
+		return &Error{http.StatusNotFound, "no such user"}
+	}
+	u := User{ID: c.Param("id"), Name: "John"}
+	if c.Query("verbose") == "1" {
+		u.Name += " (" + c.Header("User-Agent") + ")"
+	}
+	return JSON(c, http.StatusOK, u)
+}
+
+func echo(c Context) error {
+	b, err := c.Body()
+	if err != nil {
+		return err
+	}
+	c.SetHeader("Content-Type", "text/plain")
+	_, err = c.Write(b)
+	return err
+}
+
+func main() {
+	httpAddr := flag.String("http", ":8080", "the net/http address, empty to disable")
+	fastAddr := flag.String("fasthttp", ":8081", "the fasthttp address, empty to disable")
+	flag.Parse()
+	if *httpAddr == "" && *fastAddr == "" {
+		log.Fatal("nothing to serve")
+	}
+
+	r := new(Router)
+	r.Use(Logger, Recover)
+	r.Handle(http.MethodGet, "/", func(c Context) error {
+		_, err := fmt.Fprint(c, "hello world")
+		return err
+	})
+	r.Handle(http.MethodGet, "/users/:id", getUser)
+	r.Handle(http.MethodPost, "/echo", echo)
+	r.Handle(http.MethodDelete, "/users/:id", func(c Context) error {
+		c.SetStatus(http.StatusNoContent)
+		return nil
+	})
+
+	errc := make(chan error, 2)
+	if *httpAddr != "" {
+		go func() {
+			srv := &http.Server{
+				Addr:              *httpAddr,
+				Handler:           r,
+				ReadHeaderTimeout: 5 * time.Second,
+			}
+			log.Printf("net/http listening to %s", *httpAddr)
+			errc <- srv.ListenAndServe()
+		}()
+	}
+	if *fastAddr != "" {
+		go func() {
+			srv := &fasthttp.Server{
+				Handler:     r.ServeFastHTTP,
+				ReadTimeout: 5 * time.Second,
+			}
+			log.Printf("fasthttp listening to %s", *fastAddr)
+			errc <- srv.ListenAndServe(*fastAddr)
+		}()
+	}
+	log.Println("press ctrl + c to cancel.")
+	log.Fatal(<-errc)
+}
@@ -1,77 +1,545 @@
-// This program demonstrates how to write a struct to json file
+// This program demonstrates how to write structs to a file in several
+// formats, streaming the output instead of building it in memory.
+//
+// Slices, arrays and iter.Seq values are written one element at a time, so
+// an export can stream rows from a cursor without holding the document.
+//
+// HTTP handlers use Respond to pick the format from the Accept header.
 
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
 )
 
+var ErrUnknownFormat = errors.New("unknown format")
+
 // Point represents the schema of our json output
 type Point struct {
 	X int `json:"x"`
 	Y int `json:"y"`
 }
 
-// func writeJSONAlt(file string, obj interface{}, pretty bool) (err error) {
-// 	var bytes []byte
-// 	if pretty {
-// 		bytes, err = json.MarshalIndent(obj, "", "  ")
-// 	} else {
-// 		bytes, err = json.Marshal(obj)
-// 	}
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return ioutil.WriteFile(file, bytes, 0644)
-// }
-
-func writeJSON(w io.WriteCloser, obj interface{}, pretty bool) (err error) {
-	var bytes []byte
+// Encoder writes a value to w in one format.
+type Encoder interface {
+	Encode(w io.Writer, v any, pretty bool) error
+}
+
+// EncoderFunc adapts a function to an Encoder.
+type EncoderFunc func(w io.Writer, v any, pretty bool) error
+
+func (f EncoderFunc) Encode(w io.Writer, v any, pretty bool) error {
+	return f(w, v, pretty)
+}
+
+var (
+	mu       sync.RWMutex
+	encoders = map[string]Encoder{
+		"json":   EncoderFunc(encodeJSON),
+		"ndjson": EncoderFunc(encodeNDJSON),
+		"xml":    EncoderFunc(encodeXML),
+		"csv":    EncoderFunc(encodeCSV),
+		"yaml":   EncoderFunc(encodeYAML),
+	}
+)
+
+// RegisterEncoder adds or replaces the encoder of a format.
+func RegisterEncoder(format string, e Encoder) {
+	mu.Lock()
+	encoders[format] = e
+	mu.Unlock()
+}
+
+// Formats returns the registered formats, sorted.
+func Formats() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	res := make([]string, 0, len(encoders))
+	for f := range encoders {
+		res = append(res, f)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func lookupEncoder(format string) (Encoder, error) {
+	mu.RLock()
+	e, ok := encoders[format]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+	return e, nil
+}
+
+// Encode writes v to w in the format.
+func Encode(w io.Writer, format string, v any, pretty bool) error {
+	e, err := lookupEncoder(format)
+	if err != nil {
+		return err
+	}
+	return e.Encode(w, v, pretty)
+}
+
+// WriteFile writes v to the file atomically: the output goes to a temporary
+// file in the same directory, which is renamed over the file only once
+// everything is written and synced. Readers never see a partial file.
+func WriteFile(file, format string, v any, pretty bool) (err error) {
+	e, err := lookupEncoder(format)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	if err := e.Encode(bw, v, pretty); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// elements calls fn for each element of a slice, array or iter.Seq, and
+// reports false if v is none of these. It stops at the first error.
+func elements(v any, fn func(any) error) (bool, error) {
+	rv := reflect.ValueOf(v)
+	if _, ok := elemType(rv); !ok {
+		return false, nil
+	}
+	if rv.Kind() != reflect.Func {
+		for i := 0; i < rv.Len(); i++ {
+			if err := fn(rv.Index(i).Interface()); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	var err error
+	rv.Call([]reflect.Value{reflect.MakeFunc(rv.Type().In(0), func(args []reflect.Value) []reflect.Value {
+		err = fn(args[0].Interface())
+		return []reflect.Value{reflect.ValueOf(err == nil)}
+	})})
+	return true, err
+}
+
+// elemType returns the element type of a slice, array or iter.Seq, without
+// reading the elements, and false if v is none of these.
+func elemType(rv reflect.Value) (reflect.Type, bool) {
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return nil, false
+		}
+		return rv.Type().Elem(), true
+	case reflect.Func:
+		t := rv.Type()
+		if t.NumIn() != 1 || t.NumOut() != 0 {
+			return nil, false
+		}
+		yield := t.In(0)
+		if yield.Kind() != reflect.Func || yield.NumIn() != 1 || yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+			return nil, false
+		}
+		return yield.In(0), true
+	}
+	return nil, false
+}
+
+func encodeJSON(w io.Writer, v any, pretty bool) error {
+	marshal := json.Marshal
+	sep, end := []byte(","), []byte("]\n")
 	if pretty {
-		bytes, err = json.MarshalIndent(obj, "", "  ")
-	} else {
-		bytes, err = json.Marshal(obj)
+		marshal = func(v any) ([]byte, error) {
+			return json.MarshalIndent(v, "  ", "  ")
+		}
+		sep, end = []byte(",\n  "), []byte("\n]\n")
 	}
+
+	n := 0
+	ok, err := elements(v, func(e any) error {
+		b, err := marshal(e)
+		if err != nil {
+			return err
+		}
+		prefix := sep
+		if n == 0 {
+			prefix = []byte("[")
+			if pretty {
+				prefix = []byte("[\n  ")
+			}
+		}
+		n++
+		if _, err := w.Write(prefix); err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	w.Write(bytes)
-	return
+	if ok {
+		if n == 0 {
+			end = []byte("[]\n")
+		}
+		_, err := w.Write(end)
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
+}
+
+// encodeNDJSON writes one element per line. Pretty printing does not apply.
+func encodeNDJSON(w io.Writer, v any, _ bool) error {
+	enc := json.NewEncoder(w)
+	ok, err := elements(v, enc.Encode)
+	if ok || err != nil {
+		return err
+	}
+	return enc.Encode(v)
 }
 
-func writeXML(w io.WriteCloser, obj interface{}, pretty bool) (err error) {
-	var bytes []byte
+func encodeXML(w io.Writer, v any, pretty bool) error {
+	enc := xml.NewEncoder(w)
 	if pretty {
-		bytes, err = xml.MarshalIndent(obj, "", "  ")
-	} else {
-		bytes, err = xml.Marshal(obj)
+		enc.Indent("", "  ")
+	}
+	ok, err := elements(v, enc.Encode)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// encodeCSV writes structs as rows, with a header from the csv or json tags
+// of the fields, or []string rows as is. Pretty printing does not apply.
+func encodeCSV(w io.Writer, v any, _ bool) error {
+	cw := csv.NewWriter(w)
+	header := false
+	ok, err := elements(v, func(e any) error {
+		if row, ok := e.([]string); ok {
+			return cw.Write(row)
+		}
+		rv := reflect.Indirect(reflect.ValueOf(e))
+		if rv.Kind() != reflect.Struct {
+			return fmt.Errorf("csv: want struct or []string rows, got %T", e)
+		}
+		fields := csvFields(rv.Type())
+		if !header {
+			header = true
+			names := make([]string, len(fields))
+			for i, f := range fields {
+				names[i] = f.name
+			}
+			if err := cw.Write(names); err != nil {
+				return err
+			}
+		}
+		row := make([]string, len(fields))
+		for i, f := range fields {
+			row[i] = fmt.Sprint(rv.Field(f.index).Interface())
+		}
+		return cw.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("csv: want a slice or iter.Seq of rows, got %T", v)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvRows reports whether encodeCSV accepts v, from its type only.
+// Elements of interface type are only checked while encoding.
+func csvRows(v any) bool {
+	t, ok := elemType(reflect.ValueOf(v))
+	if !ok {
+		return false
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t == reflect.TypeFor[[]string]() || t.Kind() == reflect.Struct || t.Kind() == reflect.Interface
+}
+
+type csvField struct {
+	name  string
+	index int
+}
+
+func csvFields(t reflect.Type) []csvField {
+	var res []csvField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		for _, key := range []string{"csv", "json"} {
+			if tag, ok := f.Tag.Lookup(key); ok {
+				name, _, _ = strings.Cut(tag, ",")
+				break
+			}
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		res = append(res, csvField{name, i})
 	}
+	return res
+}
+
+// encodeYAML writes a sequence one element at a time. YAML is always block
+// style, so pretty printing does not apply.
+func encodeYAML(w io.Writer, v any, _ bool) error {
+	n := 0
+	ok, err := elements(v, func(e any) error {
+		n++
+		b, err := yaml.Marshal([]any{e})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	w.Write(bytes)
-	return
+	if ok {
+		if n == 0 {
+			_, err = io.WriteString(w, "[]\n")
+		}
+		return err
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// offers are the media types Respond serves, in order of preference when
+// the client accepts several equally.
+var offers = []struct {
+	mediaType, format string
+}{
+	{"application/json", "json"},
+	{"application/xml", "xml"},
+	{"text/xml", "xml"},
+	{"text/csv", "csv"},
+	{"application/x-ndjson", "ndjson"},
+}
+
+// accepted is a media range of the Accept header.
+type accepted struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(header string) []accepted {
+	var res []accepted
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		res = append(res, accepted{mt, q})
+	}
+	return res
+}
+
+// quality returns the quality of the media type under the most specific
+// matching range, or -1 if no range matches.
+func quality(ranges []accepted, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := -1.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.mediaType == mediaType:
+			s = 2
+		case r.mediaType == typ+"/*":
+			s = 1
+		case r.mediaType == "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// Negotiate returns the offered media type with the highest quality in the
+// Accept header, and false if none is acceptable. An empty header accepts
+// anything.
+func Negotiate(accept string) (mediaType, format string, ok bool) {
+	return negotiate(accept, func(string) bool { return true })
+}
+
+// negotiate is like Negotiate, but only offers the formats that can encode.
+func negotiate(accept string, can func(format string) bool) (mediaType, format string, ok bool) {
+	ranges := parseAccept(accept)
+	if strings.TrimSpace(accept) == "" {
+		ranges = []accepted{{"*/*", 1}}
+	}
+
+	best := 0.0
+	for _, o := range offers {
+		if !can(o.format) {
+			continue
+		}
+		if q := quality(ranges, o.mediaType); q > best {
+			best, mediaType, format = q, o.mediaType, o.format
+		}
+	}
+	return mediaType, format, best > 0
+}
+
+// Respond writes v with the status, in the format negotiated from the
+// Accept header. It replies 406 with the supported media types when none
+// is acceptable, and pretty prints when the query has pretty=1. CSV is only
+// offered for rows. Errors after the header is sent can only be returned,
+// for the caller to log.
+func Respond(w http.ResponseWriter, r *http.Request, status int, v any) error {
+	w.Header().Add("Vary", "Accept")
+
+	can := func(format string) bool {
+		return format != "csv" || csvRows(v)
+	}
+	mediaType, format, ok := negotiate(strings.Join(r.Header.Values("Accept"), ","), can)
+	if !ok {
+		var supported []string
+		for _, o := range offers {
+			if can(o.format) {
+				supported = append(supported, o.mediaType)
+			}
+		}
+		http.Error(w, "supported media types: "+strings.Join(supported, ", "), http.StatusNotAcceptable)
+		return nil
+	}
+
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	if strings.HasPrefix(mediaType, "text/") {
+		mediaType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+
+	return Encode(w, format, v, pretty)
 }
 
 func main() {
-	points := []Point{Point{0, 0}, Point{1, 1}}
-	var w io.WriteCloser
-	var err error
+	points := []Point{{0, 0}, {1, 1}}
 
 	runningInPlayGround := os.Getenv("user") == ""
-	if !runningInPlayGround {
-		w, err = os.Create("myfile.txt")
-		if err != nil {
+	if runningInPlayGround {
+		for _, format := range Formats() {
+			fmt.Printf("%s:\n", format)
+			if err := Encode(os.Stdout, format, points, true); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := Respond(w, r, http.StatusOK, points); err != nil {
+				log.Println(err)
+			}
+		})
+		for _, accept := range []string{"", "text/csv", "application/xml;q=0.9, application/json;q=0.8", "text/*, application/x-ndjson;q=0.1", "image/png"} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/points?pretty=0", nil)
+			req.Header.Set("Accept", accept)
+			handler.ServeHTTP(rec, req)
+			fmt.Printf("Accept: %q -> %d %s\n%s", accept, rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+
+		// A single point is not rows, so CSV is not offered for it.
+		single := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := Respond(w, r, http.StatusOK, points[1]); err != nil {
+				log.Println(err)
+			}
+		})
+		for _, accept := range []string{"text/csv, application/json;q=0.5", "text/csv"} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/points/1", nil)
+			req.Header.Set("Accept", accept)
+			single.ServeHTTP(rec, req)
+			fmt.Printf("Accept: %q -> %d %s\n%s", accept, rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+		return
+	}
+
+	for _, format := range Formats() {
+		if err := WriteFile("myfile."+format, format, points, true); err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		w = os.Stdout
 	}
-	writeJSON(w, points, true)
-	writeXML(w, points, true)
-	w.Close()
 }